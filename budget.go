@@ -0,0 +1,112 @@
+package pubysuby
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy decides which topic gives up messages when the hub exceeds its memory budget
+type EvictionPolicy int
+
+const (
+	// EvictOldest removes the oldest messages across all topics first
+	EvictOldest EvictionPolicy = iota
+	// EvictLargestTopic removes the oldest messages of the topic holding the most bytes first
+	EvictLargestTopic
+)
+
+// HubStats is a snapshot of the hub's memory usage
+type HubStats struct {
+	Topics        int
+	Bytes         int64
+	MaxTotalBytes int64
+}
+
+// memoryBudget tracks the payload bytes retained by all topics of a hub
+type memoryBudget struct {
+	usedBytes int64 // accessed atomically
+	maxBytes  int64
+	exceeded  chan struct{}
+}
+
+func newMemoryBudget(maxBytes int64) *memoryBudget {
+	return &memoryBudget{maxBytes: maxBytes, exceeded: make(chan struct{}, 1)}
+}
+
+// add records retained bytes and signals the eviction controller once the budget is exceeded,
+// it never blocks so topic controllers keep serving commands
+func (b *memoryBudget) add(delta int) {
+	if b == nil {
+		return
+	}
+	used := atomic.AddInt64(&b.usedBytes, int64(delta))
+	if delta > 0 && b.maxBytes > 0 && used > b.maxBytes {
+		select {
+		case b.exceeded <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *memoryBudget) used() int64 {
+	return atomic.LoadInt64(&b.usedBytes)
+}
+
+// Retrieves the hub's topic count and memory usage
+func (ps *PubySuby) HubStats() HubStats {
+	return HubStats{
+		Topics:        len(ps.Topics()),
+		Bytes:         ps.budget.used(),
+		MaxTotalBytes: ps.budget.maxBytes,
+	}
+}
+
+func (ps *PubySuby) evictionController() {
+	for range ps.budget.exceeded {
+		for ps.budget.used() > ps.budget.maxBytes {
+			if !ps.evictOnce() {
+				// nothing left to evict
+				break
+			}
+		}
+	}
+}
+
+// evictOnce trims the topic picked by the eviction policy and reports whether anything was removed
+func (ps *PubySuby) evictOnce() bool {
+	var victim *TopicHandle
+	var victimStats TopicStats
+	// with EvictOldest the victim only gives up messages older than the next oldest topic's
+	nextOldest := time.Now()
+	for _, th := range ps.Topics() {
+		stats := th.Stats()
+		if stats.Messages == 0 {
+			continue
+		}
+		switch {
+		case victim == nil:
+			victim, victimStats = th, stats
+		case ps.options.EvictionPolicy == EvictLargestTopic:
+			if stats.Bytes > victimStats.Bytes {
+				victim, victimStats = th, stats
+			}
+		case stats.OldestCreatedTime.Before(victimStats.OldestCreatedTime):
+			nextOldest = victimStats.OldestCreatedTime
+			victim, victimStats = th, stats
+		case stats.OldestCreatedTime.Before(nextOldest):
+			nextOldest = stats.OldestCreatedTime
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	cmd := evictCommand{
+		bytes:        ps.budget.used() - ps.budget.maxBytes,
+		replyChannel: make(chan int),
+	}
+	if ps.options.EvictionPolicy == EvictOldest {
+		cmd.createdBefore = nextOldest
+	}
+	victim.commandChannel <- cmd
+	return <-cmd.replyChannel > 0
+}
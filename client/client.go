@@ -0,0 +1,387 @@
+// Package client uses a remote PubySuby hub served by the httpapi package.
+//
+// The methods mirror the in-process PubySuby API. Requests that fail on the network
+// or with a server error are retried with exponential backoff, a Push is retried with
+// the same idempotency key so the message is published once.
+// A Sub long-polls the hub from the last message id it delivered, so after a dropped
+// connection it resumes without missing or repeating messages. A Sub the hub rejects
+// with a client error closes its ListenChannel, Err returns the error.
+// Messages a Sub could not resume with, because the hub trimmed them or the topic started over,
+// are reported to the Client's OnGap.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/httpapi"
+)
+
+// defaults of the Client's settings
+const (
+	defaultPollTimeout = time.Second * 25
+	defaultMinBackoff  = time.Millisecond * 100
+	defaultMaxBackoff  = time.Second * 10
+	defaultRetries     = 5
+)
+
+// StatusError is returned when the hub answered with an error status
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: status %d: %s", e.StatusCode, e.Message)
+}
+
+// Client of a remote hub
+type Client struct {
+	baseURL string
+	// HTTPClient sends the requests
+	HTTPClient *http.Client
+	// PollTimeout is how long a single long poll of a Sub waits on the hub
+	PollTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the wait between retries, it doubles after every failure
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retries is how often Push, Pull, PullSince and LastMessageId retry a failed request
+	Retries int
+	// Logf, when set, logs the subscriptions losing and regaining the connection to the hub
+	Logf func(format string, v ...interface{})
+	// OnGap, when set, is called by a subscription before it delivers the messages that follow a gap:
+	// with a *pubysuby.TrimmedError when messages were trimmed before they were pulled,
+	// or an error wrapping pubysuby.ErrStaleCursor when the topic started over
+	OnGap func(sub *Subscription, err error)
+}
+
+// New creates a Client for the hub whose httpapi handler is mounted at the base URL,
+// for example "http://localhost:8888/api"
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		HTTPClient:  http.DefaultClient,
+		PollTimeout: defaultPollTimeout,
+		MinBackoff:  defaultMinBackoff,
+		MaxBackoff:  defaultMaxBackoff,
+		Retries:     defaultRetries,
+	}
+}
+
+// Subscription delivers the messages of a remote topic until it is unsubscribed
+type Subscription struct {
+	TopicName     string
+	ListenChannel chan []pubysuby.TopicItem
+	cancel        context.CancelFunc
+	done          chan struct{}
+	// the error that ended the subscription, set before ListenChannel is closed
+	err error
+}
+
+// Err returns the error the hub answered with when it ended the subscription,
+// it is nil while the ListenChannel is open and after Unsubscribe
+func (sub *Subscription) Err() error {
+	select {
+	case <-sub.done:
+		return sub.err
+	default:
+		return nil
+	}
+}
+
+// Publishes the message to the topic and returns its message id
+func (c *Client) Push(topic string, message string) (int64, error) {
+	msgId, err := newMsgId()
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(httpapi.PublishRequest{Message: message, MsgId: msgId})
+	if err != nil {
+		return 0, err
+	}
+	var published httpapi.PublishResponse
+	err = c.retry(context.Background(), func(ctx context.Context) error {
+		return c.do(ctx, http.MethodPost, c.topicURL(topic, "messages", nil), body, &published)
+	})
+	return published.Id, err
+}
+
+// Pull all messages from the topic
+// If none are in the topic, blocks for the timeout duration in milliseconds until new message is published
+func (c *Client) Pull(topic string, timeout int64) ([]pubysuby.TopicItem, error) {
+	return c.PullSince(topic, timeout, 0)
+}
+
+// Pull all messages published after the since message id
+// If none are in the topic, blocks for the timeout duration in milliseconds until new message is published
+func (c *Client) PullSince(topic string, timeout int64, since int64) ([]pubysuby.TopicItem, error) {
+	var items []pubysuby.TopicItem
+	err := c.retry(context.Background(), func(ctx context.Context) error {
+		pulled, err := c.pull(ctx, topic, timeout, pubysuby.Cursor{MessageId: since})
+		items = toTopicItems(pulled.Messages)
+		return err
+	})
+	return items, err
+}
+
+// Returns the id of the last message published to the topic
+func (c *Client) LastMessageId(topic string) (int64, error) {
+	last, err := c.last(context.Background(), topic)
+	return last.LastMessageId, err
+}
+
+// Subscribe to all new messages for the topic
+func (c *Client) Sub(topic string) *Subscription {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := &Subscription{
+		TopicName:     topic,
+		ListenChannel: make(chan []pubysuby.TopicItem),
+		cancel:        cancel,
+		done:          make(chan struct{}),
+	}
+	go c.poll(ctx, sub)
+	return sub
+}
+
+// Unsubscribe stops the subscription and closes its ListenChannel
+func (c *Client) Unsubscribe(sub *Subscription) {
+	sub.cancel()
+	<-sub.done
+}
+
+// poll long-polls the topic from the last delivered message id until the subscription is cancelled
+func (c *Client) poll(ctx context.Context, sub *Subscription) {
+	defer close(sub.done)
+	defer close(sub.ListenChannel)
+
+	// like an in-process Sub, start after the messages already in the topic
+	var cursor pubysuby.Cursor
+	err := c.retryForever(ctx, func(ctx context.Context) error {
+		last, err := c.last(ctx, sub.TopicName)
+		cursor = pubysuby.Cursor{Generation: last.Generation, MessageId: last.LastMessageId}
+		return err
+	})
+	if err != nil {
+		sub.err = err
+		return
+	}
+	timeout := int64(c.PollTimeout / time.Millisecond)
+	for {
+		var pulled httpapi.PullResponse
+		var restarted bool
+		since := cursor.MessageId
+		err := c.retryForever(ctx, func(ctx context.Context) error {
+			var err error
+			pulled, err = c.pull(ctx, sub.TopicName, timeout, cursor)
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusGone {
+				// the topic started over, every message of its new generation is new to this subscription
+				restarted = true
+				last, lastErr := c.last(ctx, sub.TopicName)
+				if lastErr != nil {
+					return lastErr
+				}
+				cursor = pubysuby.Cursor{Generation: last.Generation}
+				pulled, err = c.pull(ctx, sub.TopicName, timeout, cursor)
+			}
+			return err
+		})
+		if err != nil {
+			sub.err = err
+			return
+		}
+		if restarted {
+			c.gap(sub, fmt.Errorf("%w: topic %q started over after message id %d", pubysuby.ErrStaleCursor, sub.TopicName, since))
+		}
+		if pulled.Trimmed {
+			c.gap(sub, &pubysuby.TrimmedError{Topic: sub.TopicName, Since: cursor.MessageId, FirstAvailableId: pulled.FirstAvailableId})
+		}
+		if len(pulled.Messages) == 0 {
+			continue
+		}
+		items := toTopicItems(pulled.Messages)
+		for _, item := range items {
+			if item.MessageId > cursor.MessageId {
+				cursor = item.Cursor()
+			}
+		}
+		select {
+		case sub.ListenChannel <- items:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// gap reports messages the subscription could not resume with to OnGap
+func (c *Client) gap(sub *Subscription, err error) {
+	if c.OnGap != nil {
+		c.OnGap(sub, err)
+	}
+}
+
+func (c *Client) pull(ctx context.Context, topic string, timeout int64, cursor pubysuby.Cursor) (httpapi.PullResponse, error) {
+	query := url.Values{}
+	query.Set("since", strconv.FormatInt(cursor.MessageId, 10))
+	query.Set("timeout", strconv.FormatInt(timeout, 10))
+	if cursor.Generation != 0 {
+		query.Set("generation", strconv.FormatInt(cursor.Generation, 10))
+	}
+	var pulled httpapi.PullResponse
+	err := c.do(ctx, http.MethodGet, c.topicURL(topic, "messages", query), nil, &pulled)
+	return pulled, err
+}
+
+func (c *Client) last(ctx context.Context, topic string) (httpapi.LastResponse, error) {
+	var last httpapi.LastResponse
+	err := c.retry(ctx, func(ctx context.Context) error {
+		return c.do(ctx, http.MethodGet, c.topicURL(topic, "last", nil), nil, &last)
+	})
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		// the hub creates a topic on its first publish or pull, until then it has no messages
+		return httpapi.LastResponse{}, nil
+	}
+	return last, err
+}
+
+// retry calls f until it succeeds, fails with an error that is not worth retrying,
+// or failed Retries more times
+func (c *Client) retry(ctx context.Context, f func(ctx context.Context) error) error {
+	backoff := c.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := f(ctx)
+		if err == nil || !retryable(err) || attempt >= c.Retries {
+			return err
+		}
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+// retryForever calls f until it succeeds, fails with an error that is not worth retrying,
+// or the context is done, it logs the first failure of a streak and the recovery from it
+func (c *Client) retryForever(ctx context.Context, f func(ctx context.Context) error) error {
+	backoff := c.MinBackoff
+	for failures := 0; ; failures++ {
+		err := f(ctx)
+		if err == nil && failures > 0 {
+			c.logf("Reconnected to the hub after %d failed attempts", failures)
+		}
+		if err == nil || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retryable(err) {
+			return err
+		}
+		if failures == 0 {
+			c.logf("Lost the connection to the hub, reconnecting: %v", err)
+		}
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, v...)
+	}
+}
+
+func (c *Client) do(ctx context.Context, method string, target string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var errorResponse httpapi.ErrorResponse
+		if json.Unmarshal(data, &errorResponse) != nil || errorResponse.Error == "" {
+			errorResponse.Error = resp.Status
+		}
+		return &StatusError{StatusCode: resp.StatusCode, Message: errorResponse.Error}
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *Client) topicURL(topic string, resource string, query url.Values) string {
+	target := c.baseURL + "/topics/" + url.PathEscape(topic) + "/" + resource
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	return target
+}
+
+// retryable reports whether the request may succeed when it is sent again
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// sleep waits for the duration, it returns false when the context is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func toTopicItems(messages []httpapi.Message) []pubysuby.TopicItem {
+	items := make([]pubysuby.TopicItem, 0, len(messages))
+	for _, message := range messages {
+		items = append(items, httpapi.ToTopicItem(message))
+	}
+	return items
+}
+
+// newMsgId returns a random idempotency key
+func newMsgId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
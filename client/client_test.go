@@ -0,0 +1,250 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/httpapi"
+)
+
+// flakyHandler answers 503 while down is set, failing is the number of requests it still fails after serving them
+type flakyHandler struct {
+	handler http.Handler
+	down    int32
+	failing int32
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.down) == 1 {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if atomic.AddInt32(&h.failing, -1) >= 0 {
+		// the hub handles the request, but the answer is lost
+		h.handler.ServeHTTP(httptest.NewRecorder(), r)
+		http.Error(w, "lost", http.StatusBadGateway)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+func newTestClient(handler http.Handler) (*Client, func()) {
+	server := httptest.NewServer(handler)
+	c := New(server.URL)
+	c.PollTimeout = time.Millisecond * 100
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = time.Millisecond * 20
+	return c, server.Close
+}
+
+func TestPushAndPull(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	flaky := &flakyHandler{handler: httpapi.New(ps), failing: 1}
+	c, cleanup := newTestClient(flaky)
+	defer cleanup()
+
+	// the first attempt is published but its answer is lost, the retry must not publish it again
+	id, err := c.Push("test topic", "hello")
+	if err != nil || id != 1 {
+		t.Fatalf("Expected message id 1, got %d %v", id, err)
+	}
+	if messages := ps.Stats("test topic").Messages; messages != 1 {
+		t.Errorf("Expected the retried push to publish once, got %d messages", messages)
+	}
+	c.Push("test topic", "world")
+
+	items, err := c.PullSince("test topic", 1000, 1)
+	if err != nil || len(items) != 1 || items[0].Message != "world" || items[0].MessageId != 2 {
+		t.Errorf("Expected the message after 1, got %+v %v", items, err)
+	}
+	if items, _ := c.Pull("test topic", 1000); len(items) != 2 {
+		t.Errorf("Expected both messages, got %+v", items)
+	}
+	if last, err := c.LastMessageId("test topic"); err != nil || last != 2 {
+		t.Errorf("Expected last message id 2, got %d %v", last, err)
+	}
+}
+
+func TestSubResumes(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	flaky := &flakyHandler{handler: httpapi.New(ps)}
+	c, cleanup := newTestClient(flaky)
+	defer cleanup()
+
+	ps.Push("test", "before the sub")
+	sub := c.Sub("test")
+	// wait until the subscription polls after the existing message
+	for ps.Stats("test").Pullers == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ps.Push("test", "first")
+	if items := receive(t, sub); len(items) != 1 || items[0].Message != "first" {
+		t.Fatalf("Expected the first message, got %+v", items)
+	}
+
+	atomic.StoreInt32(&flaky.down, 1)
+	ps.Push("test", "second")
+	ps.Push("test", "third")
+	time.Sleep(time.Millisecond * 50)
+	atomic.StoreInt32(&flaky.down, 0)
+
+	var received []string
+	for len(received) < 2 {
+		for _, item := range receive(t, sub) {
+			received = append(received, item.Message)
+		}
+	}
+	if len(received) != 2 || received[0] != "second" || received[1] != "third" {
+		t.Errorf("Expected to resume with the messages published while down, got %v", received)
+	}
+
+	c.Unsubscribe(sub)
+	if _, ok := <-sub.ListenChannel; ok {
+		t.Errorf("Expected the ListenChannel to be closed")
+	}
+}
+
+func TestSubGaps(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	flaky := &flakyHandler{handler: httpapi.New(ps)}
+	c, cleanup := newTestClient(flaky)
+	defer cleanup()
+	logged := make(chan string, 10)
+	c.Logf = func(format string, v ...interface{}) {
+		logged <- fmt.Sprintf(format, v...)
+	}
+	gaps := make(chan error, 10)
+	c.OnGap = func(sub *Subscription, err error) {
+		gaps <- err
+	}
+
+	sub := c.Sub("test")
+	defer c.Unsubscribe(sub)
+	for ps.Stats("test").Pullers == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&flaky.down, 1)
+	// the long poll in flight still reaches the hub, wait until it ended
+	for ps.Stats("test").Pullers != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// push past maxItemsLength while the hub is unreachable, so the first messages are trimmed
+	for i := 0; i < 150; i++ {
+		ps.Push("test", strconv.Itoa(i))
+	}
+	time.Sleep(time.Millisecond * 50)
+	atomic.StoreInt32(&flaky.down, 0)
+
+	items := receive(t, sub)
+	var trimmed *pubysuby.TrimmedError
+	select {
+	case err := <-gaps:
+		if !errors.As(err, &trimmed) || trimmed.FirstAvailableId != items[0].MessageId {
+			t.Errorf("Expected a TrimmedError up to message %d, got %v", items[0].MessageId, err)
+		}
+	default:
+		t.Error("Expected the trimmed messages to be reported before the rest were delivered")
+	}
+	// both are logged before the messages are delivered
+	for _, want := range []string{"Lost the connection", "Reconnected"} {
+		select {
+		case message := <-logged:
+			if !strings.HasPrefix(message, want) {
+				t.Errorf("Expected %q to be logged, got %q", want, message)
+			}
+		default:
+			t.Errorf("Expected %q to be logged", want)
+		}
+	}
+}
+
+func TestNoRetryOnClientErrors(t *testing.T) {
+	t.Parallel()
+	var requests int32
+	c, cleanup := newTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"bad"}`))
+	}))
+	defer cleanup()
+
+	_, err := c.LastMessageId("test")
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.StatusCode != http.StatusBadRequest || statusErr.Message != "bad" {
+		t.Errorf("Expected a 400 StatusError, got %v", err)
+	}
+	if requests := atomic.LoadInt32(&requests); requests != 1 {
+		t.Errorf("Expected a single request, got %d", requests)
+	}
+}
+
+func TestSubStopsOnClientErrors(t *testing.T) {
+	t.Parallel()
+	var requests int32
+	c, cleanup := newTestClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":"forbidden"}`))
+	}))
+	defer cleanup()
+
+	sub := c.Sub("test")
+	select {
+	case _, ok := <-sub.ListenChannel:
+		if ok {
+			t.Fatal("Expected no messages")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected the subscription to end on a client error")
+	}
+	if statusErr, ok := sub.Err().(*StatusError); !ok || statusErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 StatusError, got %v", sub.Err())
+	}
+	if requests := atomic.LoadInt32(&requests); requests != 1 {
+		t.Errorf("Expected a single request, got %d", requests)
+	}
+	c.Unsubscribe(sub)
+}
+
+func TestSubBeforeFirstPublish(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	c, cleanup := newTestClient(httpapi.New(ps))
+	defer cleanup()
+
+	sub := c.Sub("new")
+	defer c.Unsubscribe(sub)
+	// look the topic up without creating it, the subscription's first pull creates it
+	deadline := time.Now().Add(time.Second * 5)
+	for topic, ok := ps.LookupTopic("new"); !ok || topic.Stats().Pullers == 0; topic, ok = ps.LookupTopic("new") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the subscription to pull the new topic")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	ps.Push("new", "first")
+	if items := receive(t, sub); len(items) != 1 || items[0].Message != "first" {
+		t.Errorf("Expected the first message, got %v", items)
+	}
+}
+
+func receive(t *testing.T, sub *Subscription) []pubysuby.TopicItem {
+	select {
+	case items := <-sub.ListenChannel:
+		return items
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected messages on the subscription")
+		return nil
+	}
+}
@@ -0,0 +1,162 @@
+package pubysuby
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrUnknownCommand is reported when a topic controller receives a command it does not handle
+var ErrUnknownCommand = errors.New("pubysuby: unknown topic command")
+
+// ErrConflict is returned by PushIfLast when the topic's last message id is not the expected one
+var ErrConflict = errors.New("pubysuby: conflict")
+
+// topicCommand is a request sent to a topic controller over its CommandChannel.
+// Every command carries its own reply channel, typed for what the command returns.
+type topicCommand interface {
+	// reject tells the sender that the command could not be handled
+	reject(err error)
+}
+
+// subCommand registers a listener that receives every new message until unsubscribed
+type subCommand struct {
+	listenChannel chan []TopicItem
+	filters       []Filter
+}
+
+// reject closes the listen channel so the subscriber stops ranging over it
+func (cmd subCommand) reject(err error) {
+	close(cmd.listenChannel)
+}
+
+// pullCommand registers a one shot listener that receives the messages
+// published after since, either immediately or on the next publish
+type pullCommand struct {
+	listenChannel chan []TopicItem
+	since         int64
+	filters       []Filter
+	// byPriority orders the messages by priority instead of by message id
+	byPriority bool
+	// cursor, when set, is checked against the topic before the listener is registered,
+	// the result is sent on the buffered cursorReply and a stale cursor closes listenChannel
+	cursor      *Cursor
+	cursorReply chan error
+}
+
+// reject closes the listen channel so the pull returns no messages, a cursor pull also receives the error
+func (cmd pullCommand) reject(err error) {
+	if cmd.cursorReply != nil {
+		cmd.cursorReply <- err
+	}
+	close(cmd.listenChannel)
+}
+
+// unsubscribeCommand removes a listener registered by sub or pull and closes its channel
+type unsubscribeCommand struct {
+	listenChannel chan []TopicItem
+}
+
+// reject is a no-op, the listener stays registered and the caller has nothing to wait on
+func (cmd unsubscribeCommand) reject(err error) {}
+
+// pubCommand appends a message to the topic and fans it out to the listeners
+type pubCommand struct {
+	content   string
+	ttl       time.Duration // 0 means the topic's max age applies
+	key       string
+	tombstone bool
+	retain    bool // keep as the message delivered to new subscribers
+	headers   map[string]string
+	priority  int
+	msgId     string // idempotency key, a repeat within the dedup window is not appended again
+	// with ifLast the message is only appended when the topic's last message id is expectedLastId
+	ifLast         bool
+	expectedLastId int64
+	replyChannel   chan pubReply
+}
+
+type pubReply struct {
+	messageId int64
+	err       error
+}
+
+func (cmd pubCommand) reject(err error) {
+	cmd.replyChannel <- pubReply{err: err}
+}
+
+// lastMessageIdCommand retrieves the id of the last message published to the topic
+type lastMessageIdCommand struct {
+	replyChannel chan lastMessageIdReply
+}
+
+type lastMessageIdReply struct {
+	messageId int64
+	err       error
+}
+
+func (cmd lastMessageIdCommand) reject(err error) {
+	cmd.replyChannel <- lastMessageIdReply{err: err}
+}
+
+// statsCommand retrieves a snapshot of the topic's state
+type statsCommand struct {
+	replyChannel chan statsReply
+}
+
+type statsReply struct {
+	stats TopicStats
+	err   error
+}
+
+func (cmd statsCommand) reject(err error) {
+	cmd.replyChannel <- statsReply{err: err}
+}
+
+// evictCommand removes the oldest messages of the topic until at least bytes are freed.
+// With a non zero createdBefore it stops at the first message created after it,
+// but it always removes at least one message.
+type evictCommand struct {
+	bytes         int64
+	createdBefore time.Time
+	replyChannel  chan int // number of messages removed
+}
+
+func (cmd evictCommand) reject(err error) {
+	cmd.replyChannel <- 0
+}
+
+// configureCommand applies per topic options
+type configureCommand struct {
+	options TopicOptions
+	done    chan struct{}
+}
+
+func (cmd configureCommand) reject(err error) {
+	close(cmd.done)
+}
+
+// lockCommand makes the topic controller handle only the commands sent on holderChannel
+// until the holder closes it
+type lockCommand struct {
+	holderChannel chan topicCommand
+	locked        chan struct{}
+}
+
+func (cmd lockCommand) reject(err error) {
+	close(cmd.locked)
+}
+
+// historyCommand retrieves a page of the retained messages
+type historyCommand struct {
+	query        HistoryQuery
+	replyChannel chan historyReply
+}
+
+type historyReply struct {
+	page HistoryPage
+	err  error
+}
+
+func (cmd historyCommand) reject(err error) {
+	cmd.replyChannel <- historyReply{err: err}
+}
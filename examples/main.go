@@ -1,16 +1,25 @@
 // curl "http://localhost:8080/Pull/?topic=test&timeout=5"
 // curl "http://localhost:8080/PullSince/?since=5&topic=test&timeout=5"
-// curl "http://localhost:8080/Sub"
+// curl "http://localhost:8080/pull/?topic=test&timeout=5&filter=region+%3D%3D+%22eu%22"
+// curl -N "http://localhost:8888/chat/sub"
+// curl -N "http://localhost:8888/api/topics/test/events"
 // curl -d "topic=test&message=Hello" http://localhost:8080/Push
+// curl -d "topic=test&message=Hello&msgid=1" http://localhost:8080/Push
+// curl -d '{"message":"Hello"}' http://localhost:8888/api/topics/test/messages
+// curl "http://localhost:8888/api/topics/test/messages?since=0&timeout=5000"
 // ab -c 500 -n 10000 "http://localhost:8080/Pull/?topic=test&timeout=0"
 
 package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/httpapi"
+	"github.com/rambocoder/pubysuby/stomp"
+	"github.com/rambocoder/pubysuby/websocket"
 	"html"
 	"io"
 	"io/ioutil"
@@ -20,7 +29,6 @@ import (
 	"os"
 	"runtime"
 	"strconv"
-	"time"
 )
 
 var ps *pubysuby.PubySuby
@@ -43,6 +51,9 @@ func main() {
 	http.HandleFunc("/chat/sub", HandleSub)
 	http.HandleFunc("/chat/start", HandleLastMessageId)
 	http.HandleFunc("/chat/push", HandlePushJson)
+	http.Handle("/api/", http.StripPrefix("/api", httpapi.New(ps)))
+	http.Handle("/ws", websocket.New(ps))
+	http.Handle("/stomp", stomp.New(ps))
 	fmt.Println("Listening on http://localhost:8888")
 	http.ListenAndServe("localhost:8888", nil)
 }
@@ -59,7 +70,9 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 func HandlePush(w http.ResponseWriter, r *http.Request) {
 	topicName := r.FormValue("topic")
 	content := r.FormValue("message")
-	fmt.Fprintf(w, "That Message Id is: %d on topic: %q \n", ps.Push(topicName, content), topicName)
+	// a retry with the same msgid returns the message id of the first attempt
+	msgId := r.FormValue("msgid")
+	fmt.Fprintf(w, "That Message Id is: %d on topic: %q \n", ps.PushWithMsgId(topicName, msgId, content), topicName)
 }
 
 func getQuery(r *http.Request, name string) string {
@@ -72,44 +85,22 @@ func getQuery(r *http.Request, name string) string {
 	return arg_topic[0]
 }
 
-func HandleSub(w http.ResponseWriter, r *http.Request) {
-	subscription := ps.Sub("test")
-	defer ps.Unsubscribe(subscription)
-	// Ideal API for pubysuby
-	// subscription := ps.Sub("test")
-	// defer subscription.Unsubscribe()
-	// <- subscription.inChan
-	i := 0
-	for {
-		select {
-		case <-time.After(time.Second * 10):
-			fmt.Fprintf(w, "Subscription timedout")
-			return
-
-		case updates, ok := <-subscription.ListenChannel:
-			i++
-			if !ok {
-				log.Println("Updates melted down")
-				return
-			}
-
-			fmt.Println("Send to browser " + updates[0].Message)
-
-			fmt.Fprintf(w, updates[0].Message)
-
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
-
-			fmt.Println("Updates in sub:", updates)
-			if i > 5 {
-				log.Println("After 5 updates, just gonna turn off the Sub")
-				return
-			}
-			fmt.Fprintf(w, "Message Id: %d is: %q on topic: %q \n", updates[0].MessageId, updates[0].Message, html.EscapeString("test"))
-		}
-
+// getFilters parses the optional filter expression of the request
+func getFilters(r *http.Request) ([]pubysuby.Filter, error) {
+	expression := getQuery(r, "filter")
+	if expression == "" {
+		return nil, nil
 	}
+	filter, err := pubysuby.ParseFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	return []pubysuby.Filter{filter}, nil
+}
+
+// HandleSub streams the test topic as Server-Sent Events
+func HandleSub(w http.ResponseWriter, r *http.Request) {
+	httpapi.StreamEvents(w, r, ps.Topic("test"), 0)
 }
 
 func HandlePull(w http.ResponseWriter, r *http.Request) {
@@ -118,9 +109,14 @@ func HandlePull(w http.ResponseWriter, r *http.Request) {
 	timeout := getQuery(r, "timeout")
 
 	wait, _ := strconv.ParseInt(timeout, 10, 64)
+	filters, err := getFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	var messages []pubysuby.TopicItem
-	messages = ps.Pull(topicName, wait)
+	messages = ps.Pull(topicName, wait, filters...)
 
 	for _, v := range messages {
 		fmt.Fprintf(w, "Message Id: %d is: %q on topic: %q \n", v.MessageId, v.Message, html.EscapeString(topicName))
@@ -172,8 +168,23 @@ func HandlePullSince(w http.ResponseWriter, r *http.Request) {
 	since := getQuery(r, "since")
 	wait, _ := strconv.ParseInt(timeout, 10, 64)
 	lastMessageId, _ := strconv.ParseInt(since, 10, 64)
+	filters, err := getFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the chat only keeps the since message id, so the cursor is always in the current generation
+	topic := ps.Topic(topicName)
+	cursor := pubysuby.Cursor{Generation: topic.Stats().Generation, MessageId: lastMessageId}
 	var messages []pubysuby.TopicItem
-	messages = ps.PullSince(topicName, wait, lastMessageId)
+	messages, err = topic.PullSinceCursor(wait, cursor, filters...)
+	if errors.Is(err, pubysuby.ErrStaleCursor) {
+		// the since message id is from before a restart, start over from the last message
+		fmt.Fprintf(w, `{"ok":"timeout", "timestamp":"%d", "missed":true}`, topic.LastMessageId())
+		return
+	}
+	// the messages after since were trimmed before this client pulled them
+	missed := errors.Is(err, pubysuby.ErrCursorTrimmed)
 
 	if len(messages) > 0 {
 
@@ -181,7 +192,7 @@ func HandlePullSince(w http.ResponseWriter, r *http.Request) {
 			fmt.Println("Mesage to send out" + v.Message)
 			fmt.Printf("Message Id: %d is: %q on topic: %q \n", v.MessageId, v.Message, html.EscapeString(topicName))
 
-			fmt.Fprintf(w, `{"ok":{"text":"%s"}, "timestamp":"%d"}`, v.Message, v.MessageId)
+			fmt.Fprintf(w, `{"ok":{"text":"%s"}, "timestamp":"%d", "missed":%t}`, v.Message, v.MessageId, missed)
 		}
 	} else {
 		fmt.Printf(`{"ok":"timeout", "timestamp":"%d"}\n`, lastMessageId)
@@ -28,6 +28,9 @@ jQuery(document).ready(function($) {
 				success: function(data) {
 					if("ok" in data) {
 						timestamp  = data.timestamp;
+						if (data.missed) {
+							chatDisplay.error("You missed some messages");
+						}
 						if ( typeof data.ok.text == "undefined")
 						{
 							// means that a timeout was trigered on the server
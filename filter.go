@@ -0,0 +1,417 @@
+package pubysuby
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter decides whether a message is delivered to a subscriber or puller,
+// it is evaluated by the topic controller
+type Filter interface {
+	Match(item TopicItem) bool
+}
+
+// FilterFunc adapts a Go predicate to a Filter
+type FilterFunc func(item TopicItem) bool
+
+func (f FilterFunc) Match(item TopicItem) bool {
+	return f(item)
+}
+
+// Expression is a Filter parsed from its text form, so it can be sent over the wire.
+//
+// Identifiers refer to fields of the JSON payload, nested fields are joined with dots (customer.region),
+// identifiers starting with "headers." refer to the message headers (headers.source).
+// Literals are double or single quoted strings, numbers, true, false and null.
+// Operators are == != < <= > >= ! && || and parentheses, e.g. region == "eu" && amount > 100
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+// ParseFilter parses the text form of an Expression
+func ParseFilter(source string) (*Expression, error) {
+	p := exprParser{source: source}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("pubysuby: unexpected %q in filter %q", p.tokens[p.pos].text, source)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+func (e *Expression) Match(item TopicItem) bool {
+	return truthy(e.root.eval(&exprEnv{item: item}))
+}
+
+// String returns the text form of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+func (e *Expression) MarshalText() ([]byte, error) {
+	return []byte(e.source), nil
+}
+
+func (e *Expression) UnmarshalText(text []byte) error {
+	parsed, err := ParseFilter(string(text))
+	if err != nil {
+		return err
+	}
+	*e = *parsed
+	return nil
+}
+
+// MatchAll reports whether the item passes every filter, nil filters match everything
+func MatchAll(filters []Filter, item TopicItem) bool {
+	for _, filter := range filters {
+		if filter != nil && !filter.Match(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// exprEnv resolves identifiers for a single item, decoding its JSON payload at most once
+type exprEnv struct {
+	item    TopicItem
+	decoded bool
+	payload interface{}
+}
+
+func (env *exprEnv) lookup(path string) interface{} {
+	if strings.HasPrefix(path, "headers.") {
+		value, ok := env.item.Headers[strings.TrimPrefix(path, "headers.")]
+		if !ok {
+			return nil
+		}
+		return value
+	}
+	if !env.decoded {
+		env.decoded = true
+		// a payload that is not JSON has no fields
+		_ = json.Unmarshal([]byte(env.item.Message), &env.payload)
+	}
+	value := env.payload
+	for _, field := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[field]
+	}
+	return value
+}
+
+type exprNode interface {
+	eval(env *exprEnv) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n literalNode) eval(env *exprEnv) interface{} {
+	return n.value
+}
+
+type identNode struct {
+	path string
+}
+
+func (n identNode) eval(env *exprEnv) interface{} {
+	return env.lookup(n.path)
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n notNode) eval(env *exprEnv) interface{} {
+	return !truthy(n.operand.eval(env))
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(env *exprEnv) interface{} {
+	switch n.op {
+	case "&&":
+		return truthy(n.left.eval(env)) && truthy(n.right.eval(env))
+	case "||":
+		return truthy(n.left.eval(env)) || truthy(n.right.eval(env))
+	}
+	return compare(n.op, n.left.eval(env), n.right.eval(env))
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+// compare applies a comparison operator, a string compared to a number is read as a number
+// so that header values can be compared numerically
+func compare(op string, left, right interface{}) bool {
+	if l, ok := left.(float64); ok {
+		if r, ok := asNumber(right); ok {
+			return compareOrdered(op, l < r, l == r)
+		}
+	}
+	if r, ok := right.(float64); ok {
+		if l, ok := asNumber(left); ok {
+			return compareOrdered(op, l < r, l == r)
+		}
+	}
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			return compareOrdered(op, l < r, l == r)
+		}
+	}
+	// other values of the same kind, such as booleans and null, can only be tested for equality
+	equal := fmt.Sprintf("%T%v", left, left) == fmt.Sprintf("%T%v", right, right)
+	switch op {
+	case "==":
+		return equal
+	case "!=":
+		return !equal
+	}
+	return false
+}
+
+func asNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(v, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "==":
+		return equal
+	case "!=":
+		return !equal
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	}
+	return false
+}
+
+type exprTokenKind int
+
+const (
+	tokenIdent exprTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+}
+
+type exprParser struct {
+	source string
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) tokenize() error {
+	src := p.source
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(src) && src[end] != src[i] {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return fmt.Errorf("pubysuby: unterminated string in filter %q", p.source)
+			}
+			text := src[i+1 : end]
+			if c == '"' {
+				unquoted, err := strconv.Unquote(src[i : end+1])
+				if err != nil {
+					return fmt.Errorf("pubysuby: bad string in filter %q: %v", p.source, err)
+				}
+				text = unquoted
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokenString, text: text})
+			i = end + 1
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1]))):
+			end := i + 1
+			for end < len(src) && (unicode.IsDigit(rune(src[end])) || src[end] == '.') {
+				end++
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokenNumber, text: src[i:end]})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i + 1
+			for end < len(src) && (unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end])) || src[end] == '_' || src[end] == '.' || src[end] == '-') {
+				end++
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokenIdent, text: src[i:end]})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("pubysuby: unexpected %q in filter %q", c, p.source)
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokenOperator, text: op})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+// accept consumes the next token if it is one of the operators
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode{op: op, left: left, right: right}, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.accept("!"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	if _, ok := p.accept("("); ok {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("pubysuby: missing ) in filter %q", p.source)
+		}
+		return inner, nil
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("pubysuby: unexpected end of filter %q", p.source)
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token.kind {
+	case tokenString:
+		return literalNode{value: token.text}, nil
+	case tokenNumber:
+		n, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("pubysuby: bad number %q in filter %q", token.text, p.source)
+		}
+		return literalNode{value: n}, nil
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			return literalNode{value: true}, nil
+		case "false":
+			return literalNode{value: false}, nil
+		case "null":
+			return literalNode{value: nil}, nil
+		}
+		return identNode{path: token.text}, nil
+	}
+	return nil, fmt.Errorf("pubysuby: unexpected %q in filter %q", token.text, p.source)
+}
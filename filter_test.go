@@ -0,0 +1,93 @@
+package pubysuby
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	t.Parallel()
+
+	item := TopicItem{
+		Message: `{"region":"eu","amount":150,"customer":{"vip":true},"note":null}`,
+		Headers: map[string]string{"source": "web", "retries": "3"},
+	}
+	cases := []struct {
+		expression string
+		match      bool
+	}{
+		{`region == "eu" && amount > 100`, true},
+		{`region == 'us' || amount >= 150`, true},
+		{`region != "eu"`, false},
+		{`!(amount < 100) && customer.vip`, true},
+		{`customer.vip == false`, false},
+		{`note == null && missing == null`, true},
+		{`headers.source == "web" && headers.retries > 2`, true},
+		{`headers.missing == "web"`, false},
+		{`amount <= -1`, false},
+	}
+	for _, c := range cases {
+		filter, err := ParseFilter(c.expression)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", c.expression, err)
+			continue
+		}
+		if filter.Match(item) != c.match {
+			t.Errorf("Expected %q to match %v", c.expression, c.match)
+		}
+	}
+
+	for _, bad := range []string{`region ==`, `(amount > 1`, `region = "eu"`, `"unterminated`, `amount > 1 )`} {
+		if _, err := ParseFilter(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestFilterTravelsAsText(t *testing.T) {
+	t.Parallel()
+
+	filter, _ := ParseFilter(`amount > 100`)
+	encoded, err := json.Marshal(struct{ Filter *Expression }{filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct{ Filter *Expression }
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Filter.String() != "amount > 100" || !decoded.Filter.Match(TopicItem{Message: `{"amount":101}`}) {
+		t.Error("Expected the filter to survive a JSON round trip, got ", decoded.Filter)
+	}
+}
+
+func TestFilteredSubAndPull(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	eu, _ := ParseFilter(`region == "eu"`)
+	subscription := ps.Sub("TestFilteredSubAndPull", eu)
+	big := FilterFunc(func(item TopicItem) bool { return len(item.Message) > 20 })
+
+	ps.Push("TestFilteredSubAndPull", `{"region":"us"}`)
+	euId := ps.Push("TestFilteredSubAndPull", `{"region":"eu"}`)
+	select {
+	case messages := <-subscription.ListenChannel:
+		if messages[0].MessageId != euId {
+			t.Error("Expected only the eu message, got ", messages)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the eu message, got nothing")
+	}
+	ps.Unsubscribe(subscription)
+
+	bigId := ps.Push("TestFilteredSubAndPull", `{"region":"eu","padding":"xxxx"}`)
+	messages := ps.Pull("TestFilteredSubAndPull", 1000, eu, big)
+	if len(messages) != 1 || messages[0].MessageId != bigId {
+		t.Error("Expected only the big eu message, got ", messages)
+	}
+	if messages := ps.PullSince("TestFilteredSubAndPull", 1, bigId, eu); len(messages) != 0 {
+		t.Error("Expected nothing since the big eu message, got ", messages)
+	}
+}
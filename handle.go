@@ -0,0 +1,270 @@
+package pubysuby
+
+import (
+	"errors"
+	"time"
+)
+
+// TopicHandle is bound directly to a topic's command channel,
+// so calls made through it skip the hub lookup
+type TopicHandle struct {
+	topicName      string
+	commandChannel chan topicCommand
+}
+
+// TopicStats is a snapshot of a topic's state
+type TopicStats struct {
+	TopicName     string
+	Messages      int
+	Subscribers   int
+	Pullers       int
+	LastMessageId int64
+	Generation    int64
+	// id of the oldest retained message, 0 when the topic is empty
+	FirstMessageId int64
+	// highest message id removed by the retention limits
+	TrimmedUpTo int64
+	// total payload bytes of the retained messages
+	Bytes int
+	// creation time of the oldest retained message, zero when the topic is empty
+	OldestCreatedTime time.Time
+}
+
+// TopicOptions configures a single topic
+type TopicOptions struct {
+	// Compacted topics keep the latest message per Key past the max age and item count limits,
+	// GC removes the messages superseded by a newer one with the same Key
+	Compacted bool
+	// DedupWindow is how long the idempotency keys of published messages are remembered,
+	// 0 means two minutes
+	DedupWindow time.Duration
+}
+
+// Topic returns a handle for the topic, creating the topic if needed
+func (ps *PubySuby) Topic(topic string) *TopicHandle {
+	return &TopicHandle{
+		topicName:      topic,
+		commandChannel: ps.getTopicRequestChannel(topic),
+	}
+}
+
+// LookupTopic returns a handle for the topic if it was already created
+func (ps *PubySuby) LookupTopic(topic string) (*TopicHandle, bool) {
+	reply := make(chan chan topicCommand)
+	ps.hubRequests <- hubRequest{topicName: topic, hubReplyChannel: reply, lookup: true}
+	commandChannel := <-reply
+	if commandChannel == nil {
+		return nil, false
+	}
+	return &TopicHandle{topicName: topic, commandChannel: commandChannel}, true
+}
+
+// Name of the topic the handle is bound to
+func (th *TopicHandle) Name() string {
+	return th.topicName
+}
+
+// Subscribe to all new messages for the topic that pass the filters
+func (th *TopicHandle) Sub(filters ...Filter) *Subscription {
+	myListenChannel := make(chan []TopicItem)
+
+	th.commandChannel <- subCommand{listenChannel: myListenChannel, filters: filters}
+
+	return &Subscription{
+		TopicName:     th.topicName,
+		ListenChannel: myListenChannel,
+	}
+}
+
+func (th *TopicHandle) Unsubscribe(subscription *Subscription) {
+	th.commandChannel <- unsubscribeCommand{listenChannel: subscription.ListenChannel}
+}
+
+// Pull all messages from the topic that pass the filters
+// If none are in the topic, blocks for the timeout duration in milliseconds until new message is published
+// The messages come ordered by priority, and by MessageId within a priority
+func (th *TopicHandle) Pull(timeout int64, filters ...Filter) []TopicItem {
+	myListenChannel := make(chan []TopicItem)
+	defer drainRemaining(myListenChannel)
+
+	th.commandChannel <- pullCommand{listenChannel: myListenChannel, filters: filters, byPriority: true}
+	return th.waitPull(myListenChannel, nil, timeout)
+}
+
+// Pull all messages published after the since message id that pass the filters
+// If none are in the topic, blocks for the timeout duration in milliseconds until new message is published
+// The messages come ordered by MessageId, so the next pull resumes from the last one
+func (th *TopicHandle) PullSince(timeout int64, since int64, filters ...Filter) []TopicItem {
+	return th.PullSinceUntil(nil, timeout, since, filters...)
+}
+
+// PullSinceUntil is PullSince that also stops waiting, with no messages, once done is closed
+func (th *TopicHandle) PullSinceUntil(done <-chan struct{}, timeout int64, since int64, filters ...Filter) []TopicItem {
+	myListenChannel := make(chan []TopicItem)
+	defer drainRemaining(myListenChannel)
+
+	th.commandChannel <- pullCommand{listenChannel: myListenChannel, since: since, filters: filters}
+	return th.waitPull(myListenChannel, done, timeout)
+}
+
+// Pull the messages published after the cursor, or ErrStaleCursor when the cursor
+// is from another generation of the topic, for example from before the hub restarted
+// When messages after the cursor were already trimmed, the remaining messages are returned
+// with a *TrimmedError that wraps ErrCursorTrimmed
+// The topic checks the cursor as part of the pull, so no trim or restart can slip in between
+func (th *TopicHandle) PullSinceCursor(timeout int64, cursor Cursor, filters ...Filter) ([]TopicItem, error) {
+	myListenChannel := make(chan []TopicItem)
+	defer drainRemaining(myListenChannel)
+
+	cursorReply := make(chan error, 1)
+	th.commandChannel <- pullCommand{listenChannel: myListenChannel, since: cursor.MessageId, filters: filters,
+		cursor: &cursor, cursorReply: cursorReply}
+	err := <-cursorReply
+	if err != nil && !errors.Is(err, ErrCursorTrimmed) {
+		return nil, err
+	}
+	return th.waitPull(myListenChannel, nil, timeout), err
+}
+
+// waitPull waits up to timeout milliseconds, or until done is closed, for the results of a pull command
+func (th *TopicHandle) waitPull(myListenChannel chan []TopicItem, done <-chan struct{}, timeout int64) []TopicItem {
+	if timeout < 1 {
+		timeout = 1
+	}
+	var receivedMessages []TopicItem
+	select {
+	case results := <-myListenChannel:
+		// a rejected pull closes the channel and returns no messages
+		receivedMessages = results
+	case <-time.After(time.Millisecond * time.Duration(timeout)):
+		th.stopPull(myListenChannel)
+	case <-done:
+		th.stopPull(myListenChannel)
+	}
+	return receivedMessages
+}
+
+// stopPull unregisters a pull that is no longer waited on
+func (th *TopicHandle) stopPull(myListenChannel chan []TopicItem) {
+	go func() {
+		th.commandChannel <- unsubscribeCommand{listenChannel: myListenChannel}
+	}()
+}
+
+// Publishes the message to the topic and returns the message id
+func (th *TopicHandle) Push(message string) int64 {
+	return th.PushWithTTL(message, 0)
+}
+
+// Publishes the message to the topic and returns the message id,
+// the message expires after ttl instead of the topic's max age when ttl is positive
+func (th *TopicHandle) PushWithTTL(message string, ttl time.Duration) int64 {
+	return th.push(pubCommand{content: message, ttl: ttl})
+}
+
+// Publishes the message unless a message with the same idempotency key was published within the topic's dedup window,
+// returns the message id of the first message published with the key
+func (th *TopicHandle) PushWithMsgId(msgId string, message string) int64 {
+	return th.push(pubCommand{content: message, msgId: msgId})
+}
+
+// Publishes the message with a priority, pending messages of higher priority are delivered first
+func (th *TopicHandle) PushWithPriority(message string, priority int) int64 {
+	return th.push(pubCommand{content: message, priority: priority})
+}
+
+// Publishes the message with headers that filters can match on and returns the message id
+func (th *TopicHandle) PushWithHeaders(headers map[string]string, message string) int64 {
+	return th.push(pubCommand{content: message, headers: headers})
+}
+
+// Publishes the message as the latest value of the key and returns the message id
+func (th *TopicHandle) PushWithKey(key string, message string) int64 {
+	return th.push(pubCommand{content: message, key: key})
+}
+
+// Publishes the message and keeps it as the topic's retained message,
+// which is delivered right away to every new subscriber and puller even after the que trimmed it.
+// An empty message clears the retained message.
+func (th *TopicHandle) PushRetained(message string) int64 {
+	return th.push(pubCommand{content: message, retain: true})
+}
+
+// Publishes a tombstone that deletes the key from a compacted topic and returns the message id
+func (th *TopicHandle) DeleteKey(key string) int64 {
+	return th.push(pubCommand{key: key, tombstone: true})
+}
+
+// Publishes the message only if the topic's last message id is expectedLastId,
+// otherwise returns an error wrapping ErrConflict
+func (th *TopicHandle) PushIfLast(message string, expectedLastId int64) (int64, error) {
+	reply := th.send(pubCommand{content: message, ifLast: true, expectedLastId: expectedLastId})
+	return reply.messageId, reply.err
+}
+
+// PushOptions combines the options of the PushWith variants for a single message
+type PushOptions struct {
+	TTL      time.Duration
+	Key      string
+	Headers  map[string]string
+	Priority int
+	MsgId    string
+	Retain   bool
+	// with IfLast the message is only published when the topic's last message id is ExpectedLastId
+	IfLast         bool
+	ExpectedLastId int64
+}
+
+// Publishes the message with the options and returns the message id,
+// the error wraps ErrConflict when IfLast is set and the topic moved on
+func (th *TopicHandle) PushWithOptions(message string, options PushOptions) (int64, error) {
+	reply := th.send(pubCommand{
+		content:        message,
+		ttl:            options.TTL,
+		key:            options.Key,
+		headers:        options.Headers,
+		priority:       options.Priority,
+		msgId:          options.MsgId,
+		retain:         options.Retain,
+		ifLast:         options.IfLast,
+		expectedLastId: options.ExpectedLastId,
+	})
+	return reply.messageId, reply.err
+}
+
+// push returns the message id, or 0 when the topic rejected the message
+func (th *TopicHandle) push(cmd pubCommand) int64 {
+	return th.send(cmd).messageId
+}
+
+func (th *TopicHandle) send(cmd pubCommand) pubReply {
+	cmd.replyChannel = make(chan pubReply)
+	th.commandChannel <- cmd
+	return <-cmd.replyChannel
+}
+
+// Applies the options to the topic
+func (th *TopicHandle) Configure(options TopicOptions) {
+	done := make(chan struct{})
+	th.commandChannel <- configureCommand{options: options, done: done}
+	<-done
+}
+
+// Retrieves the id of the last message published to the topic, 0 when the topic rejected the request
+func (th *TopicHandle) LastMessageId() int64 {
+	replyChannel := make(chan lastMessageIdReply)
+	th.commandChannel <- lastMessageIdCommand{replyChannel: replyChannel}
+	return (<-replyChannel).messageId
+}
+
+// Retrieves a snapshot of the topic's message and subscriber counts,
+// only the topic name is set when the topic rejected the request
+func (th *TopicHandle) Stats() TopicStats {
+	replyChannel := make(chan statsReply)
+	th.commandChannel <- statsCommand{replyChannel: replyChannel}
+	reply := <-replyChannel
+	if reply.err != nil {
+		return TopicStats{TopicName: th.topicName}
+	}
+	return reply.stats
+}
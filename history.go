@@ -0,0 +1,69 @@
+package pubysuby
+
+import (
+	"container/list"
+	"time"
+)
+
+// how many messages a History page holds when the query has no Limit
+const defaultHistoryLimit = 100
+
+// HistoryQuery selects a page of retained messages
+type HistoryQuery struct {
+	// From and To bound the message ids of the page, both inclusive, 0 means unbounded
+	From int64
+	To   int64
+	// Limit caps the number of messages in the page, 0 means 100
+	Limit int
+	// Reverse returns the newest messages first
+	Reverse bool
+}
+
+// HistoryPage is a page of retained messages
+type HistoryPage struct {
+	Items []TopicItem
+	// Next is the message id the following page starts at, 0 when there are no more messages.
+	// Query the following page with From: Next, or To: Next when Reverse.
+	Next int64
+}
+
+// Retrieves a page of the messages retained by the topic without waiting for new ones,
+// the page is empty when the topic rejected the query
+func (th *TopicHandle) History(query HistoryQuery) HistoryPage {
+	replyChannel := make(chan historyReply)
+	th.commandChannel <- historyCommand{query: query, replyChannel: replyChannel}
+	return (<-replyChannel).page
+}
+
+// Retrieves a page of the messages retained by the topic without waiting for new ones
+func (ps *PubySuby) History(topic string, query HistoryQuery) HistoryPage {
+	return ps.Topic(topic).History(query)
+}
+
+func (t *Topic) history(query HistoryQuery) HistoryPage {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	inRange := func(id int64) bool {
+		return (query.From == 0 || id >= query.From) && (query.To == 0 || id <= query.To)
+	}
+	now := time.Now()
+	var page HistoryPage
+	e, step := t.messages.Front(), (*list.Element).Next
+	if query.Reverse {
+		e, step = t.messages.Back(), (*list.Element).Prev
+	}
+	for ; e != nil; e = step(e) {
+		item := e.Value.(TopicItem)
+		if !inRange(item.MessageId) || t.expired(e, now) {
+			continue
+		}
+		if len(page.Items) == limit {
+			page.Next = item.MessageId
+			break
+		}
+		page.Items = append(page.Items, item)
+	}
+	return page
+}
@@ -0,0 +1,407 @@
+// Package httpapi serves a PubySuby hub over a JSON REST API.
+//
+// Mount the handler under any prefix, for example
+//
+//	http.Handle("/api/", http.StripPrefix("/api", httpapi.New(ps)))
+//
+// Routes, with topic names path escaped:
+//
+//	POST /topics/{topic}/messages   publish a message, 201 with the message id, 409 when expected_last_id does not match,
+//	                                413 when the body is over MaxBodyBytes
+//	GET  /topics/{topic}/messages   pull, ?since=&timeout=&filter=&generation=, 410 when the cursor is stale
+//	GET  /topics/{topic}/events     Server-Sent Events of new messages, ?filter=, replays after Last-Event-ID
+//	GET  /topics/{topic}/history    a page of retained messages, ?from=&to=&limit=&reverse=
+//	GET  /topics/{topic}/last       the last message id and generation of the topic
+//	GET  /topics/{topic}/stats      the stats of the topic
+//	GET  /topics                    the names of the topics
+//	GET  /stats                     the stats of the hub
+//
+// Only publishing, pulling and streaming events create a topic,
+// the history, last and stats routes answer 404 for a topic that does not exist.
+// Errors are answered with a JSON body {"error": "..."}.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+)
+
+// how long a pull may wait for messages unless the Handler says otherwise
+const defaultMaxTimeout = time.Second * 30
+
+// how large a publish request may be unless the Handler says otherwise
+const defaultMaxBodyBytes = 1 << 20
+
+// Handler serves the REST API of a hub
+type Handler struct {
+	ps *pubysuby.PubySuby
+	// MaxTimeout caps the timeout a pull may ask for
+	MaxTimeout time.Duration
+	// Heartbeat is how often an idle event stream sends a comment
+	Heartbeat time.Duration
+	// MaxBodyBytes caps the size of a publish request, larger ones are answered with 413
+	MaxBodyBytes int64
+}
+
+// New creates a Handler for the hub
+func New(ps *pubysuby.PubySuby) *Handler {
+	return &Handler{ps: ps, MaxTimeout: defaultMaxTimeout, Heartbeat: defaultHeartbeat, MaxBodyBytes: defaultMaxBodyBytes}
+}
+
+// Message is the JSON form of a pubysuby.TopicItem
+type Message struct {
+	Id          int64             `json:"id"`
+	Generation  int64             `json:"generation"`
+	Message     string            `json:"message"`
+	CreatedTime time.Time         `json:"created_time"`
+	Key         string            `json:"key,omitempty"`
+	Tombstone   bool              `json:"tombstone,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+	MsgId       string            `json:"msg_id,omitempty"`
+}
+
+// PublishRequest is the JSON body of POST /topics/{topic}/messages
+type PublishRequest struct {
+	Message  string            `json:"message"`
+	Key      string            `json:"key,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+	// MsgId is the idempotency key, a retry with the same MsgId returns the original id
+	MsgId  string `json:"msg_id,omitempty"`
+	Retain bool   `json:"retain,omitempty"`
+	// TTL is a Go duration such as "30s"
+	TTL string `json:"ttl,omitempty"`
+	// ExpectedLastId publishes only when the topic's last message id matches
+	ExpectedLastId *int64 `json:"expected_last_id,omitempty"`
+}
+
+// PublishResponse answers a publish
+type PublishResponse struct {
+	Id int64 `json:"id"`
+}
+
+// PullResponse answers a pull
+type PullResponse struct {
+	Messages []Message `json:"messages"`
+	// Trimmed is set when messages after since were removed before they were pulled
+	Trimmed          bool  `json:"trimmed,omitempty"`
+	FirstAvailableId int64 `json:"first_available_id,omitempty"`
+}
+
+// HistoryResponse answers a history query
+type HistoryResponse struct {
+	Messages []Message `json:"messages"`
+	Next     int64     `json:"next"`
+}
+
+// LastResponse answers GET /topics/{topic}/last
+type LastResponse struct {
+	LastMessageId int64 `json:"last_message_id"`
+	Generation    int64 `json:"generation"`
+}
+
+// ErrorResponse is the body of every error
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments, err := splitPath(r.URL.EscapedPath())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch {
+	case len(segments) == 1 && segments[0] == "stats":
+		if allow(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, h.ps.HubStats())
+		}
+	case len(segments) == 1 && segments[0] == "topics":
+		if allow(w, r, http.MethodGet) {
+			h.topics(w)
+		}
+	case len(segments) == 3 && segments[0] == "topics":
+		h.topicRoute(w, r, segments[1], segments[2])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+	}
+}
+
+// topicRoute checks the route and method before it looks up the topic,
+// only publishing and subscribing create a missing topic
+func (h *Handler) topicRoute(w http.ResponseWriter, r *http.Request, name string, route string) {
+	switch route {
+	case "messages":
+		if r.Method == http.MethodPost {
+			h.publish(w, r, name)
+		} else if allow(w, r, http.MethodGet, http.MethodPost) {
+			h.pull(w, r, name)
+		}
+	case "events":
+		if allow(w, r, http.MethodGet) {
+			filters, err := parseFilters(r.URL.Query())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			StreamEvents(w, r, h.ps.Topic(name), h.Heartbeat, filters...)
+		}
+	case "history", "last", "stats":
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		topic, ok := h.ps.LookupTopic(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no topic %q", name))
+			return
+		}
+		switch route {
+		case "history":
+			h.history(w, r, topic)
+		case "last":
+			stats := topic.Stats()
+			writeJSON(w, http.StatusOK, LastResponse{LastMessageId: stats.LastMessageId, Generation: stats.Generation})
+		case "stats":
+			writeJSON(w, http.StatusOK, topic.Stats())
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+	}
+}
+
+func (h *Handler) topics(w http.ResponseWriter) {
+	names := []string{}
+	for _, topic := range h.ps.Topics() {
+		names = append(names, topic.Name())
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (h *Handler) publish(w http.ResponseWriter, r *http.Request, name string) {
+	// read one byte past the cap to tell a body at the cap from a larger one
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, h.MaxBodyBytes+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad publish request: %v", err))
+		return
+	}
+	if int64(len(body)) > h.MaxBodyBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("publish request over %d bytes", h.MaxBodyBytes))
+		return
+	}
+	var req PublishRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad publish request: %v", err))
+		return
+	}
+	options := pubysuby.PushOptions{
+		Key:      req.Key,
+		Headers:  req.Headers,
+		Priority: req.Priority,
+		MsgId:    req.MsgId,
+		Retain:   req.Retain,
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad ttl: %v", err))
+			return
+		}
+		options.TTL = ttl
+	}
+	if req.ExpectedLastId != nil {
+		options.IfLast = true
+		options.ExpectedLastId = *req.ExpectedLastId
+	}
+	id, err := h.ps.Topic(name).PushWithOptions(req.Message, options)
+	if errors.Is(err, pubysuby.ErrConflict) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, PublishResponse{Id: id})
+}
+
+func (h *Handler) pull(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	since, err := intParam(query, "since")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	timeout, err := intParam(query, "timeout")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if max := int64(h.MaxTimeout / time.Millisecond); timeout > max {
+		timeout = max
+	}
+	filters, err := parseFilters(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cursor := pubysuby.Cursor{MessageId: since}
+	if query.Get("generation") != "" {
+		if cursor.Generation, err = intParam(query, "generation"); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	topic := h.ps.Topic(name)
+	if query.Get("generation") == "" {
+		// without a generation the since id is taken to be from the current one
+		cursor.Generation = topic.Stats().Generation
+	}
+	items, err := topic.PullSinceCursor(timeout, cursor, filters...)
+	var trimmed *pubysuby.TrimmedError
+	resp := PullResponse{Messages: toMessages(items)}
+	if errors.As(err, &trimmed) {
+		resp.Trimmed = true
+		resp.FirstAvailableId = trimmed.FirstAvailableId
+	} else if errors.Is(err, pubysuby.ErrStaleCursor) {
+		writeError(w, http.StatusGone, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) history(w http.ResponseWriter, r *http.Request, topic *pubysuby.TopicHandle) {
+	query := r.URL.Query()
+	var historyQuery pubysuby.HistoryQuery
+	var err error
+	if historyQuery.From, err = intParam(query, "from"); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if historyQuery.To, err = intParam(query, "to"); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := intParam(query, "limit")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	historyQuery.Limit = int(limit)
+	historyQuery.Reverse = query.Get("reverse") == "true"
+	page := topic.History(historyQuery)
+	writeJSON(w, http.StatusOK, HistoryResponse{Messages: toMessages(page.Items), Next: page.Next})
+}
+
+// ToMessage converts a pubysuby.TopicItem to its JSON form
+func ToMessage(item pubysuby.TopicItem) Message {
+	return Message{
+		Id:          item.MessageId,
+		Generation:  item.Generation,
+		Message:     item.Message,
+		CreatedTime: item.CreatedTime,
+		Key:         item.Key,
+		Tombstone:   item.Tombstone,
+		Headers:     item.Headers,
+		Priority:    item.Priority,
+		MsgId:       item.MsgId,
+	}
+}
+
+// ToTopicItem converts the JSON form back to a pubysuby.TopicItem
+func ToTopicItem(message Message) pubysuby.TopicItem {
+	return pubysuby.TopicItem{
+		MessageId:   message.Id,
+		Generation:  message.Generation,
+		Message:     message.Message,
+		CreatedTime: message.CreatedTime,
+		Key:         message.Key,
+		Tombstone:   message.Tombstone,
+		Headers:     message.Headers,
+		Priority:    message.Priority,
+		MsgId:       message.MsgId,
+	}
+}
+
+func toMessages(items []pubysuby.TopicItem) []Message {
+	messages := make([]Message, 0, len(items))
+	for _, item := range items {
+		messages = append(messages, ToMessage(item))
+	}
+	return messages
+}
+
+// splitPath splits the escaped path into unescaped segments, so topic names may contain a slash
+func splitPath(escapedPath string) ([]string, error) {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(escapedPath, "/"), "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, fmt.Errorf("bad path: %v", err)
+		}
+		segments = append(segments, unescaped)
+	}
+	return segments, nil
+}
+
+// parseFilters parses the optional filter expression of the query
+func parseFilters(query url.Values) ([]pubysuby.Filter, error) {
+	expression := query.Get("filter")
+	if expression == "" {
+		return nil, nil
+	}
+	filter, err := pubysuby.ParseFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	return []pubysuby.Filter{filter}, nil
+}
+
+func intParam(query url.Values, name string) (int64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s: %q is not a number", name, value)
+	}
+	return n, nil
+}
+
+// allow answers 405 unless the request uses one of the methods
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
@@ -0,0 +1,119 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rambocoder/pubysuby"
+)
+
+func do(t *testing.T, handler http.Handler, method string, target string, body string, out interface{}) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s: expected a JSON response, got %q", method, target, ct)
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: bad JSON %q: %v", method, target, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestPublishAndPull(t *testing.T) {
+	handler := New(pubysuby.NewPubySuby())
+
+	var published PublishResponse
+	status := do(t, handler, "POST", "/topics/chat%2Froom/messages", `{"message":"say \"hi\"","headers":{"region":"eu"}}`, &published)
+	if status != http.StatusCreated || published.Id != 1 {
+		t.Fatalf("Expected 201 with id 1, got %d %+v", status, published)
+	}
+	do(t, handler, "POST", "/topics/chat%2Froom/messages", `{"message":"bye"}`, nil)
+
+	var pulled PullResponse
+	status = do(t, handler, "GET", "/topics/chat%2Froom/messages?timeout=1000&filter=headers.region+%3D%3D+%22eu%22", "", &pulled)
+	if status != http.StatusOK || len(pulled.Messages) != 1 || pulled.Messages[0].Message != `say "hi"` {
+		t.Errorf("Expected the quoted eu message, got %d %+v", status, pulled)
+	}
+
+	var last LastResponse
+	do(t, handler, "GET", "/topics/chat%2Froom/last", "", &last)
+	if last.LastMessageId != 2 {
+		t.Errorf("Expected last message id 2, got %+v", last)
+	}
+
+	var topics []string
+	do(t, handler, "GET", "/topics", "", &topics)
+	if len(topics) != 1 || topics[0] != "chat/room" {
+		t.Errorf("Expected the chat/room topic, got %v", topics)
+	}
+
+	var history HistoryResponse
+	do(t, handler, "GET", "/topics/chat%2Froom/history?reverse=true&limit=1", "", &history)
+	if len(history.Messages) != 1 || history.Messages[0].Message != "bye" || history.Next != 1 {
+		t.Errorf("Expected the newest message and a next page, got %+v", history)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	handler := New(pubysuby.NewPubySuby())
+	var errorResponse ErrorResponse
+
+	if status := do(t, handler, "POST", "/topics/test/messages", `{"message":`, &errorResponse); status != http.StatusBadRequest || errorResponse.Error == "" {
+		t.Errorf("Expected 400 with an error for bad JSON, got %d %+v", status, errorResponse)
+	}
+	if status := do(t, handler, "GET", "/topics/test/messages?filter=region+%3D%3D", "", &errorResponse); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad filter, got %d", status)
+	}
+	if status := do(t, handler, "POST", "/topics/test/messages", `{"message":"late","expected_last_id":5}`, &errorResponse); status != http.StatusConflict {
+		t.Errorf("Expected 409 for an unexpected last id, got %d", status)
+	}
+	if status := do(t, handler, "GET", "/topics/test/messages?since=3&generation=1", "", &errorResponse); status != http.StatusGone {
+		t.Errorf("Expected 410 for a stale cursor, got %d", status)
+	}
+	handler.MaxBodyBytes = 20
+	if status := do(t, handler, "POST", "/topics/test/messages", `{"message":"too long to publish"}`, &errorResponse); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body over MaxBodyBytes, got %d", status)
+	}
+	if status := do(t, handler, "DELETE", "/topics/test/last", "", &errorResponse); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", status)
+	}
+	if status := do(t, handler, "GET", "/nowhere", "", &errorResponse); status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", status)
+	}
+}
+
+func TestNoTopicCreatedOnReads(t *testing.T) {
+	ps := pubysuby.NewPubySuby()
+	handler := New(ps)
+	var errorResponse ErrorResponse
+
+	if status := do(t, handler, "GET", "/topics/missing/stats", "", &errorResponse); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for the stats of a missing topic, got %d", status)
+	}
+	if status := do(t, handler, "GET", "/topics/missing/history", "", &errorResponse); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for the history of a missing topic, got %d", status)
+	}
+	if status := do(t, handler, "DELETE", "/topics/missing/messages", "", &errorResponse); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", status)
+	}
+	if status := do(t, handler, "GET", "/topics/missing/nowhere", "", &errorResponse); status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", status)
+	}
+	if status := do(t, handler, "GET", "/topics/missing/messages?timeout=x", "", &errorResponse); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad timeout, got %d", status)
+	}
+	if topics := ps.Topics(); len(topics) != 0 {
+		t.Errorf("Expected no topics to be created, got %d", len(topics))
+	}
+
+	do(t, handler, "POST", "/topics/created/messages", `{"message":"hi"}`, nil)
+	if status := do(t, handler, "GET", "/topics/created/stats", "", nil); status != http.StatusOK {
+		t.Errorf("Expected the stats of a published topic, got %d", status)
+	}
+}
@@ -0,0 +1,147 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+)
+
+// how often an idle event stream sends a comment so proxies keep the connection open
+const defaultHeartbeat = time.Second * 15
+
+// how long a single pull of an event stream waits, so a disconnected client is noticed
+const maxEventPoll = time.Second
+
+// CursorEvent is the data of the events that tell the client its position in the topic was lost.
+// A "stale" event is sent when the Last-Event-ID does not belong to the topic, for example after the hub restarted,
+// and the stream continues from the topic's last message.
+// A "trimmed" event is sent when messages after the Last-Event-ID were removed by the retention limits,
+// and the stream continues from the oldest retained message.
+type CursorEvent struct {
+	Error string `json:"error"`
+	// FirstAvailableId is the id of the oldest retained message of a trimmed stream, 0 when the topic is empty
+	FirstAvailableId int64 `json:"first_available_id,omitempty"`
+}
+
+// StreamEvents streams the topic's messages to the client as Server-Sent Events until the client disconnects.
+// Every event carries the MessageId as its id and the JSON form of the message as its data.
+// When the client reconnects with a Last-Event-ID header, or a last_event_id query parameter,
+// the retained messages after it are replayed first, or every retained message for a Last-Event-ID of 0,
+// and a stale or trimmed Last-Event-ID is announced with a CursorEvent.
+//
+// The stream pulls from a cursor rather than ranging over a Subscription: a Subscription starts when it is made,
+// so a replay followed by a Subscription either repeats or loses the messages published in between,
+// while successive pulls from a cursor join the replay and the live messages at one message id.
+// Every pull waits at most a second, so a disconnected client is noticed even on a quiet topic.
+func StreamEvents(w http.ResponseWriter, r *http.Request, topic *pubysuby.TopicHandle, heartbeat time.Duration, filters ...pubysuby.Filter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported by the response writer"))
+		return
+	}
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+	var since int64
+	if lastEventId != "" {
+		var err error
+		if since, err = strconv.ParseInt(lastEventId, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad Last-Event-ID: %q is not a number", lastEventId))
+			return
+		}
+	}
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeat
+	}
+
+	// the topic checks the cursor, so a Last-Event-ID past its last message is reported as stale
+	stats := topic.Stats()
+	cursor := pubysuby.Cursor{Generation: stats.Generation, MessageId: stats.LastMessageId}
+	if lastEventId != "" {
+		cursor.MessageId = since
+	}
+	poll := heartbeat
+	if poll > maxEventPoll {
+		poll = maxEventPoll
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lastWrite := time.Now()
+	for r.Context().Err() == nil {
+		items, err := topic.PullSinceCursor(int64(poll/time.Millisecond), cursor, filters...)
+		var trimmed *pubysuby.TrimmedError
+		if errors.Is(err, pubysuby.ErrStaleCursor) {
+			if writeCursorEvent(w, "stale", CursorEvent{Error: err.Error()}) != nil {
+				return
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+			stats := topic.Stats()
+			cursor = pubysuby.Cursor{Generation: stats.Generation, MessageId: stats.LastMessageId}
+			continue
+		} else if errors.As(err, &trimmed) {
+			if writeCursorEvent(w, "trimmed", CursorEvent{Error: err.Error(), FirstAvailableId: trimmed.FirstAvailableId}) != nil {
+				return
+			}
+			flusher.Flush()
+			lastWrite = time.Now()
+			if len(items) == 0 {
+				// every message up to TrimmedUpTo is gone, so resuming there skips none that are retained
+				if trimmedUpTo := topic.Stats().TrimmedUpTo; cursor.MessageId < trimmedUpTo {
+					cursor.MessageId = trimmedUpTo
+				}
+			}
+		} else if err != nil {
+			return
+		}
+		if len(items) == 0 {
+			if time.Since(lastWrite) >= heartbeat {
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+				lastWrite = time.Now()
+			}
+			continue
+		}
+		for _, item := range items {
+			if err := writeEvent(w, item); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		lastWrite = time.Now()
+		cursor.MessageId = items[len(items)-1].MessageId
+	}
+}
+
+func writeEvent(w http.ResponseWriter, item pubysuby.TopicItem) error {
+	data, err := json.Marshal(ToMessage(item))
+	if err != nil {
+		return err
+	}
+	// encoded JSON has no newlines, so it fits in a single data field
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", item.MessageId, data)
+	return err
+}
+
+// writeCursorEvent writes a named event without an id, so the client's Last-Event-ID stays at its last message
+func writeCursorEvent(w http.ResponseWriter, event string, cursorEvent CursorEvent) error {
+	data, err := json.Marshal(cursorEvent)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,179 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+)
+
+// readEvent reads the next event from the stream, skipping heartbeats
+func readEvent(t *testing.T, reader *bufio.Reader) (string, Message) {
+	var id string
+	var message Message
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read the event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && id != "":
+			return id, message
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &message); err != nil {
+				t.Fatalf("Bad event data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+// readCursorEvent reads the next event from the stream, expecting a CursorEvent
+func readCursorEvent(t *testing.T, reader *bufio.Reader) (string, CursorEvent) {
+	var event string
+	var cursorEvent CursorEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read the event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, cursorEvent
+		case strings.HasPrefix(line, "id: "):
+			t.Fatalf("Expected a cursor event, got a message with %s", line)
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &cursorEvent); err != nil {
+				t.Fatalf("Bad event data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ps := pubysuby.NewPubySuby()
+	server := httptest.NewServer(New(ps))
+	defer server.Close()
+
+	ps.Push("test", "missed")
+	ps.Push("test", "replayed")
+
+	req, _ := http.NewRequest("GET", server.URL+"/topics/test/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %q", ct)
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	if id, message := readEvent(t, reader); id != "2" || message.Message != "replayed" {
+		t.Errorf("Expected the message after Last-Event-ID to be replayed, got %s %+v", id, message)
+	}
+	ps.Push("test", "live")
+	if id, message := readEvent(t, reader); id != "3" || message.Message != "live" {
+		t.Errorf("Expected the live message, got %s %+v", id, message)
+	}
+
+	resp.Body.Close()
+	deadline := time.Now().Add(time.Second * 5)
+	for stats := ps.Stats("test"); stats.Subscribers != 0 || stats.Pullers != 0; stats = ps.Stats("test") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the stream to stop pulling when the client disconnected")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestEventsReplayJoinsLive(t *testing.T) {
+	ps := pubysuby.NewPubySuby()
+	server := httptest.NewServer(New(ps))
+	defer server.Close()
+
+	for i := 0; i < 50; i++ {
+		ps.Push("test", "before")
+	}
+	// publish while the stream replays, every message must arrive exactly once
+	go func() {
+		for i := 0; i < 50; i++ {
+			ps.Push("test", "during")
+		}
+	}()
+	req, _ := http.NewRequest("GET", server.URL+"/topics/test/events", nil)
+	req.Header.Set("Last-Event-ID", "10")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	for want := 11; want <= 100; want++ {
+		if id, _ := readEvent(t, reader); id != strconv.Itoa(want) {
+			t.Fatalf("Expected event %d, got %s", want, id)
+		}
+	}
+}
+
+func TestEventsBadLastEventId(t *testing.T) {
+	handler := New(pubysuby.NewPubySuby())
+	var errorResponse ErrorResponse
+	if status := do(t, handler, "GET", "/topics/test/events?last_event_id=abc", "", &errorResponse); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad last event id, got %d", status)
+	}
+}
+
+func TestEventsLostCursor(t *testing.T) {
+	ps := pubysuby.NewPubySuby()
+	server := httptest.NewServer(New(ps))
+	defer server.Close()
+
+	stream := func(topic string, lastEventId string) (*bufio.Reader, func() error) {
+		req, _ := http.NewRequest("GET", server.URL+"/topics/"+topic+"/events", nil)
+		req.Header.Set("Last-Event-ID", lastEventId)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bufio.NewReader(resp.Body), resp.Body.Close
+	}
+
+	// a Last-Event-ID past the last message is from another run of the hub
+	ps.Push("stale", "one")
+	reader, closeStream := stream("stale", "5")
+	defer closeStream()
+	if event, data := readCursorEvent(t, reader); event != "stale" || data.Error == "" {
+		t.Errorf("Expected a stale event, got %s %+v", event, data)
+	}
+	ps.Push("stale", "live")
+	if id, message := readEvent(t, reader); id != "2" || message.Message != "live" {
+		t.Errorf("Expected the stream to continue from the last message, got %s %+v", id, message)
+	}
+
+	// push past maxItemsLength so the messages right after the Last-Event-ID are trimmed
+	for i := 0; i < 150; i++ {
+		ps.Push("trimmed", strconv.Itoa(i))
+	}
+	first := ps.Stats("trimmed").FirstMessageId
+	reader, closeStream = stream("trimmed", "1")
+	defer closeStream()
+	if event, data := readCursorEvent(t, reader); event != "trimmed" || data.FirstAvailableId != first {
+		t.Errorf("Expected a trimmed event with the first available id %d, got %s %+v", first, event, data)
+	}
+	if id, _ := readEvent(t, reader); id != strconv.FormatInt(first, 10) {
+		t.Errorf("Expected the stream to continue from the oldest retained message %d, got %s", first, id)
+	}
+}
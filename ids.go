@@ -0,0 +1,217 @@
+package pubysuby
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// IdScheme decides how message ids are generated
+type IdScheme int
+
+const (
+	// SequenceIds numbers the messages of each topic 1, 2, 3...
+	// Without a SequenceStore the sequence starts over whenever the topic is created,
+	// and the topic gets a new Generation so old cursors are detected as stale.
+	// With a SequenceStore the sequence and Generation carry over to the next run of the hub.
+	SequenceIds IdScheme = iota
+	// ClockIds takes the ids from a hub-wide hybrid logical clock,
+	// the wall clock in milliseconds shifted left by 16 bits plus a counter.
+	// Ids keep increasing across topics and restarts as long as the wall clock does not go back,
+	// and the Generation is always 0.
+	// A cursor from before a restart stays valid: a cursor past the topic's last message id
+	// has nothing newer yet, and the messages published after the restart follow it.
+	ClockIds
+)
+
+// how many ids a topic reserves in its SequenceStore at a time,
+// after a restart the sequence continues after the reserved ids
+const sequenceBlock = 1000
+
+// ErrStaleCursor is returned by PullSinceCursor when the cursor does not belong to the topic's current generation
+var ErrStaleCursor = errors.New("pubysuby: stale cursor")
+
+// ErrCursorTrimmed is wrapped by TrimmedError
+var ErrCursorTrimmed = errors.New("pubysuby: messages after the cursor were trimmed")
+
+// TrimmedError reports that messages after the cursor were removed by the retention limits before they were pulled
+type TrimmedError struct {
+	Topic string
+	Since int64
+	// FirstAvailableId is the id of the oldest retained message, 0 when the topic is empty
+	FirstAvailableId int64
+}
+
+func (e *TrimmedError) Error() string {
+	return fmt.Sprintf("%s: topic %q since %d, first available message id %d", ErrCursorTrimmed, e.Topic, e.Since, e.FirstAvailableId)
+}
+
+func (e *TrimmedError) Unwrap() error {
+	return ErrCursorTrimmed
+}
+
+// Cursor is a position in a topic, it stays valid only within the topic's generation
+type Cursor struct {
+	Generation int64
+	MessageId  int64
+}
+
+// Cursor of the item, to resume pulling after it
+func (item TopicItem) Cursor() Cursor {
+	return Cursor{Generation: item.Generation, MessageId: item.MessageId}
+}
+
+// SequenceStore persists the per topic sequences of SequenceIds
+type SequenceStore interface {
+	// Load returns the generation and the highest reserved id of the topic, zeros for a new topic
+	Load(topic string) (generation int64, reserved int64, err error)
+	Save(topic string, generation int64, reserved int64) error
+}
+
+// hybridClock hands out increasing ids based on the wall clock
+type hybridClock struct {
+	mu   sync.Mutex
+	last int64
+}
+
+func (c *hybridClock) next() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := (time.Now().UnixNano() / int64(time.Millisecond)) << 16
+	if id <= c.last {
+		id = c.last + 1
+	}
+	c.last = id
+	return id
+}
+
+// startSequence seeds the topic's generation and last message id
+func (t *Topic) startSequence() {
+	switch {
+	case t.clock != nil:
+		t.generation = 0
+	case t.sequenceStore != nil:
+		generation, reserved, err := t.sequenceStore.Load(t.topicName)
+		if err != nil {
+			log.Println("Failed to load the sequence of", t.topicName, err)
+		}
+		if generation == 0 {
+			generation = time.Now().UnixNano()
+		}
+		t.generation = generation
+		t.lastMessageId = reserved
+		t.reserved = reserved
+	default:
+		t.generation = time.Now().UnixNano()
+	}
+}
+
+// nextId returns the id for the next published message
+func (t *Topic) nextId() int64 {
+	if t.clock != nil {
+		t.lastMessageId = t.clock.next()
+		return t.lastMessageId
+	}
+	t.lastMessageId++
+	if t.sequenceStore != nil && t.lastMessageId > t.reserved {
+		t.reserved = t.lastMessageId + sequenceBlock
+		if err := t.sequenceStore.Save(t.topicName, t.generation, t.reserved); err != nil {
+			log.Println("Failed to save the sequence of", t.topicName, err)
+		}
+	}
+	return t.lastMessageId
+}
+
+// checkCursor reports ErrStaleCursor for a cursor from another generation or from past the last message id,
+// and a TrimmedError when messages after the cursor were trimmed.
+// With clockIds the ids keep increasing across restarts, so a cursor past the last message id is not stale.
+// The zero Cursor starts from the oldest retained message of any generation,
+// it is trimmed once any message of the topic was trimmed.
+func checkCursor(cursor Cursor, stats TopicStats, clockIds bool) error {
+	if cursor.MessageId == 0 {
+		if stats.TrimmedUpTo > 0 {
+			return &TrimmedError{Topic: stats.TopicName, Since: 0, FirstAvailableId: stats.FirstMessageId}
+		}
+		return nil
+	}
+	if cursor.Generation != stats.Generation {
+		return fmt.Errorf("%w: generation %d, topic %q is at generation %d", ErrStaleCursor, cursor.Generation, stats.TopicName, stats.Generation)
+	}
+	if cursor.MessageId > stats.LastMessageId && !clockIds {
+		return fmt.Errorf("%w: message id %d is past the last message id %d of topic %q", ErrStaleCursor, cursor.MessageId, stats.LastMessageId, stats.TopicName)
+	}
+	if cursor.MessageId < stats.TrimmedUpTo {
+		return &TrimmedError{Topic: stats.TopicName, Since: cursor.MessageId, FirstAvailableId: stats.FirstMessageId}
+	}
+	return nil
+}
+
+// FileSequenceStore keeps the sequences in a JSON file,
+// the file is rewritten every time a topic reserves a block of ids
+type FileSequenceStore struct {
+	path      string
+	mu        sync.Mutex
+	loaded    bool
+	sequences map[string]storedSequence
+}
+
+type storedSequence struct {
+	Generation int64
+	Reserved   int64
+}
+
+func NewFileSequenceStore(path string) *FileSequenceStore {
+	return &FileSequenceStore{path: path, sequences: make(map[string]storedSequence)}
+}
+
+func (fs *FileSequenceStore) Load(topic string) (int64, int64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.read(); err != nil {
+		return 0, 0, err
+	}
+	sequence := fs.sequences[topic]
+	return sequence.Generation, sequence.Reserved, nil
+}
+
+func (fs *FileSequenceStore) Save(topic string, generation int64, reserved int64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.read(); err != nil {
+		return err
+	}
+	fs.sequences[topic] = storedSequence{Generation: generation, Reserved: reserved}
+	data, err := json.Marshal(fs.sequences)
+	if err != nil {
+		return err
+	}
+	// replace the file through a rename, so a crash never leaves it half written
+	if err := ioutil.WriteFile(fs.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fs.path+".tmp", fs.path)
+}
+
+// read loads the file once
+func (fs *FileSequenceStore) read() error {
+	if fs.loaded {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		fs.loaded = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &fs.sequences); err != nil {
+		return err
+	}
+	fs.loaded = true
+	return nil
+}
@@ -0,0 +1,213 @@
+// Package frontend holds what the network front ends of a hub share:
+// tracking the listeners and connections a server closes, the state of a connection that ends once,
+// its bounded queue of deliveries, and the subscriptions that forward a topic's messages into that queue.
+// The wire protocols, their windows and acknowledgements stay in the front ends.
+package frontend
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/rambocoder/pubysuby"
+)
+
+// Server tracks the listeners and connections of a front end, so Close stops every one of them.
+// The zero value is ready to use.
+type Server struct {
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*Conn]struct{}
+}
+
+// Serve accepts connections on the listener and hands each to serve in its own goroutine,
+// until accepting fails or the Server is closed, then it returns the error or closedErr
+func (s *Server) Serve(l net.Listener, closedErr error, serve func(netConn net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return closedErr
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return closedErr
+			}
+			return err
+		}
+		go serve(netConn)
+	}
+}
+
+// Add creates the state of a connection running on closer, with room for queueSize deliveries,
+// and tracks it until End. When the Server is already closed it closes closer and returns nil.
+func (s *Server) Add(closer io.Closer, queueSize int) *Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		closer.Close()
+		return nil
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+	}
+	c := NewConn(closer, queueSize)
+	c.server = s
+	s.conns[c] = struct{}{}
+	return c
+}
+
+// Close stops the listeners and closes every connection
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Conn is the part of a connection's state every front end has.
+// The delivering goroutine takes the queued deliveries from Deliveries until Done is closed.
+type Conn struct {
+	// Deliveries holds what waits to be sent, the front end decides what it queues
+	Deliveries chan interface{}
+	// SlowConsumer ends the connection when Deliveries overflows, nil calls Close
+	SlowConsumer func()
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closer    io.Closer
+	// the Server tracking the connection, nil for NewConn
+	server *Server
+}
+
+// NewConn creates the state of a connection running on closer, with room for queueSize deliveries
+func NewConn(closer io.Closer, queueSize int) *Conn {
+	return &Conn{
+		Deliveries: make(chan interface{}, queueSize),
+		done:       make(chan struct{}),
+		closer:     closer,
+	}
+}
+
+// Done is closed once the connection ends
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close ends the connection, the reading goroutine then ends its subscriptions
+func (c *Conn) Close() {
+	c.CloseWith(nil)
+}
+
+// CloseWith ends the connection like Close, running last right before the underlying connection is closed,
+// last only runs when this call ends the connection
+func (c *Conn) CloseWith(last func()) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if last != nil {
+			last()
+		}
+		c.closer.Close()
+	})
+}
+
+// End closes the connection and stops tracking it, the goroutine serving the connection defers it
+func (c *Conn) End() {
+	c.Close()
+	if c.server != nil {
+		c.server.mu.Lock()
+		delete(c.server.conns, c)
+		c.server.mu.Unlock()
+	}
+}
+
+// Deliver queues the delivery without blocking, a full queue ends the connection with SlowConsumer
+func (c *Conn) Deliver(delivery interface{}) {
+	select {
+	case <-c.done:
+	case c.Deliveries <- delivery:
+	default:
+		if c.SlowConsumer != nil {
+			c.SlowConsumer()
+		} else {
+			c.Close()
+		}
+	}
+}
+
+// Subscription of a connection to a topic
+type Subscription struct {
+	Topic        *pubysuby.TopicHandle
+	Subscription *pubysuby.Subscription
+}
+
+// Subscribe subscribes to the topic's messages that pass the filters
+func Subscribe(topic *pubysuby.TopicHandle, filters ...pubysuby.Filter) *Subscription {
+	return &Subscription{Topic: topic, Subscription: topic.Sub(filters...)}
+}
+
+// Unsubscribe ends the subscription, Forward returns once the topic handled it
+func (s *Subscription) Unsubscribe() {
+	s.Topic.Unsubscribe(s.Subscription)
+}
+
+// Replay picks the retained messages a subscription delivers before its live messages
+type Replay struct {
+	// From is the message id the replay starts at, 0 starts at the oldest retained message
+	From int64
+	// Match picks the retained messages to replay, nil replays nothing
+	Match func(item pubysuby.TopicItem) bool
+}
+
+// Forward hands the retained messages the replay picks, then every message of the subscription, to deliver,
+// skipping the live messages the replay already handed over.
+// The topic's retained message the subscription starts with is handed over unless the replay handed over
+// that same message, whatever the ids of the messages replayed after it.
+// It keeps receiving until the subscription ends, so a slow connection never holds up the topic,
+// deliver is expected to queue the message without blocking.
+func (s *Subscription) Forward(replay Replay, deliver func(item pubysuby.TopicItem)) {
+	var replayedUpTo int64
+	replayed := make(map[int64]bool)
+	if replay.Match != nil {
+		query := pubysuby.HistoryQuery{From: replay.From}
+		for {
+			page := s.Topic.History(query)
+			for _, item := range page.Items {
+				if replay.Match(item) {
+					deliver(item)
+					replayedUpTo = item.MessageId
+					replayed[item.MessageId] = true
+				}
+			}
+			if page.Next == 0 {
+				break
+			}
+			query.From = page.Next
+		}
+	}
+	for items := range s.Subscription.ListenChannel {
+		for _, item := range items {
+			if item.Retained && !replayed[item.MessageId] || item.MessageId > replayedUpTo {
+				deliver(item)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package frontend
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+)
+
+type closer struct {
+	closed int
+}
+
+func (c *closer) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestDeliverOverflow(t *testing.T) {
+	t.Parallel()
+	underlying := &closer{}
+	c := NewConn(underlying, 1)
+	c.Deliver("first")
+	c.Deliver("second")
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("Expected the overflow to end the connection")
+	}
+	if underlying.closed != 1 || len(c.Deliveries) != 1 {
+		t.Errorf("Expected the connection closed once with the first delivery queued, got %d and %d", underlying.closed, len(c.Deliveries))
+	}
+	// a connection that ended drops the deliveries
+	c.Deliver("third")
+	c.Close()
+	if underlying.closed != 1 || len(c.Deliveries) != 1 {
+		t.Errorf("Expected nothing more after the end, got %d and %d", underlying.closed, len(c.Deliveries))
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	t.Parallel()
+	var s Server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errClosed := errors.New("closed")
+	conns := make(chan *Conn)
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, errClosed, func(netConn net.Conn) {
+			c := s.Add(netConn, 1)
+			conns <- c
+			<-c.Done()
+			c.End()
+		})
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c := <-conns
+
+	s.Close()
+	if err := <-served; err != errClosed {
+		t.Errorf("Expected Serve to return the closed error, got %v", err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected Close to end the connection")
+	}
+	if s.Add(&closer{}, 1) != nil {
+		t.Error("Expected no connection to be added after Close")
+	}
+}
+
+func TestForwardReplay(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	topic := ps.Topic("test")
+	topic.Push("old")
+	since := topic.Push("replayed")
+
+	sub := Subscribe(topic)
+	live := topic.Push("live")
+	delivered := make(chan pubysuby.TopicItem, 10)
+	go sub.Forward(Replay{From: since, Match: func(pubysuby.TopicItem) bool { return true }}, func(item pubysuby.TopicItem) {
+		delivered <- item
+	})
+
+	// the live message may be both retained and delivered by the subscription, it is handed over once
+	for _, want := range []int64{since, live} {
+		select {
+		case item := <-delivered:
+			if item.MessageId != want {
+				t.Errorf("Expected message %d, got %d", want, item.MessageId)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Expected message ", want)
+		}
+	}
+	sub.Unsubscribe()
+	select {
+	case item := <-delivered:
+		t.Error("Expected no duplicate, got ", item)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestForwardRetained(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	topic := ps.Topic("test")
+	retained := topic.PushRetained("retained")
+	replayed := topic.Push("replayed")
+
+	// the replay skips the retained message, which still comes first on the subscription
+	sub := Subscribe(topic)
+	delivered := make(chan pubysuby.TopicItem, 10)
+	go sub.Forward(Replay{Match: func(item pubysuby.TopicItem) bool { return item.MessageId > retained }}, func(item pubysuby.TopicItem) {
+		delivered <- item
+	})
+	for _, want := range []int64{replayed, retained} {
+		select {
+		case item := <-delivered:
+			if item.MessageId != want {
+				t.Errorf("Expected message %d, got %d", want, item.MessageId)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Expected message ", want)
+		}
+	}
+	sub.Unsubscribe()
+}
@@ -0,0 +1,96 @@
+// Package frontendtest holds the fixture the tests of the network front ends share:
+// serving a front end on a local port, client connections that never wait forever,
+// comparing results and waiting for the hub to see subscribers and pullers come and go.
+package frontendtest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+)
+
+// Timeout bounds every wait of a test
+const Timeout = time.Second * 5
+
+// Server is a front end serving the connections it accepts on listeners
+type Server interface {
+	Serve(l net.Listener) error
+	Close() error
+}
+
+// Listen serves the front end on a local port and closes it when the test ends
+func Listen(t *testing.T, server Server) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return l
+}
+
+// Conn is a client connection to a front end, closed when the test ends
+type Conn struct {
+	net.Conn
+	T *testing.T
+	r *bufio.Reader
+}
+
+// Dial connects to the listener
+func Dial(t *testing.T, l net.Listener) *Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &Conn{Conn: conn, T: t, r: bufio.NewReader(conn)}
+}
+
+// Reader returns the buffered reader of the connection, the reads that follow fail after Timeout
+func (c *Conn) Reader() *bufio.Reader {
+	c.SetReadDeadline(time.Now().Add(Timeout))
+	return c.r
+}
+
+// Expect fails the test unless got deeply equals want
+func Expect(t *testing.T, got interface{}, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %#v, got %#v", want, got)
+	}
+}
+
+// WaitFor polls the condition until it holds, failing the test with the description after Timeout
+func WaitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected ", description)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// WaitForSubscribers waits until the topic has n subscribers
+func WaitForSubscribers(t *testing.T, ps *pubysuby.PubySuby, topic string, n int) {
+	t.Helper()
+	WaitFor(t, fmt.Sprintf("%d subscribers to %q", n, topic), func() bool {
+		return ps.Stats(topic).Subscribers == n
+	})
+}
+
+// WaitForPullers waits until the topic has n pullers
+func WaitForPullers(t *testing.T, ps *pubysuby.PubySuby, topic string, n int) {
+	t.Helper()
+	WaitFor(t, fmt.Sprintf("%d pullers of %q", n, topic), func() bool {
+		return ps.Stats(topic).Pullers == n
+	})
+}
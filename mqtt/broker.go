@@ -0,0 +1,446 @@
+// Package mqtt serves a PubySuby hub to MQTT 3.1.1 clients.
+//
+// MQTT topic names are the hub's topic names, so MQTT devices share the topics of every other front end.
+// Subscriptions take the + and # wildcards, a wildcard subscription picks up the topics created later
+// within PatternInterval without losing their first messages. Messages are delivered with the QoS the
+// subscription was granted, 0 or 1, QoS 2 is downgraded to 1. Clients publish with any QoS, a QoS 2
+// message reaches the hub once, when its first PUBLISH arrives, and the PUBREC, PUBREL, PUBCOMP exchange
+// completes it. Publishing with the retain flag keeps the message as the topic's retained message for
+// new subscribers, and the will of a client that disconnects without a DISCONNECT is published for it.
+//
+// Sessions are always clean: the subscriptions of a client end with its connection, and so do its
+// unacknowledged QoS 1 messages, they are not sent again, as MQTT 3.1.1 allows for a clean session.
+// At most Window QoS 1 messages are unacknowledged per connection, messages that cannot be sent
+// wait in a queue of SendQueue messages and a client that lets the queue overflow is disconnected.
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend"
+)
+
+// defaults of the Server's settings
+const (
+	defaultWindow          = 64
+	defaultSendQueue       = 4096
+	defaultPatternInterval = time.Second
+	defaultConnectTimeout  = time.Second * 10
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("mqtt: server closed")
+
+// Server is an MQTT broker for a hub
+type Server struct {
+	ps *pubysuby.PubySuby
+	// Window is how many QoS 1 messages may be unacknowledged per connection, at most 65535
+	Window int
+	// SendQueue is how many messages may wait to be sent before a client is disconnected
+	SendQueue int
+	// PatternInterval is how often a wildcard subscription looks for new topics
+	PatternInterval time.Duration
+	// ConnectTimeout is how long a new connection may take to send its CONNECT
+	ConnectTimeout time.Duration
+	// MaxPacketSize is the largest packet a client may send
+	MaxPacketSize int
+	// Authenticate decides whether a client may connect, nil lets every client connect
+	Authenticate func(clientId string, username string, password string) bool
+
+	front  frontend.Server
+	mu     sync.Mutex
+	nextId int64
+	// key: client id
+	// value: its connection, a new connection with the same id takes over
+	clients map[string]*conn
+}
+
+// New creates a Server for the hub
+func New(ps *pubysuby.PubySuby) *Server {
+	return &Server{
+		ps:              ps,
+		Window:          defaultWindow,
+		SendQueue:       defaultSendQueue,
+		PatternInterval: defaultPatternInterval,
+		ConnectTimeout:  defaultConnectTimeout,
+		MaxPacketSize:   defaultMaxPacketSize,
+		clients:         make(map[string]*conn),
+	}
+}
+
+// ListenAndServe listens on the TCP address, such as ":1883", and serves the connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until it fails or the Server is closed
+func (s *Server) Serve(l net.Listener) error {
+	return s.front.Serve(l, ErrServerClosed, func(netConn net.Conn) {
+		front := s.front.Add(netConn, s.SendQueue)
+		if front == nil {
+			return
+		}
+		c := &conn{
+			server:        s,
+			netConn:       netConn,
+			front:         front,
+			w:             bufio.NewWriter(netConn),
+			acks:          make(chan uint16),
+			subscriptions: make(map[string]*filterSubscription),
+			received:      make(map[uint16]bool),
+		}
+		c.serve()
+	})
+}
+
+// Close stops the listeners and closes every connection
+func (s *Server) Close() error {
+	s.front.Close()
+	return nil
+}
+
+// filterSubscription subscribes to the topics that match its filter
+type filterSubscription struct {
+	filter string
+	qos    byte
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// conn is the state of one connection.
+// The reading goroutine owns the session and answers the packets,
+// the delivering goroutine sends the messages of the subscriptions within the window.
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	mu      sync.Mutex
+	w       *bufio.Writer
+
+	clientId  string
+	keepAlive time.Duration
+	// published when the connection ends without a DISCONNECT
+	will *message
+
+	// queues the messages of the subscriptions
+	front         *frontend.Conn
+	acks          chan uint16
+	subscriptions map[string]*filterSubscription
+	// packet ids of the QoS 2 messages the client published and has not released yet
+	received map[uint16]bool
+}
+
+// serve handles the client's packets until the connection closes,
+// then it ends every subscription and publishes the will
+func (c *conn) serve() {
+	defer func() {
+		c.front.End()
+		for _, s := range c.subscriptions {
+			close(s.stop)
+		}
+		if c.will != nil {
+			c.publish(*c.will)
+		}
+		c.server.mu.Lock()
+		if c.server.clients[c.clientId] == c {
+			delete(c.server.clients, c.clientId)
+		}
+		c.server.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(c.netConn)
+	c.netConn.SetReadDeadline(time.Now().Add(c.server.ConnectTimeout))
+	p, err := readPacket(r, c.server.MaxPacketSize)
+	if err != nil || p.kind != connectPacket || !c.connect(p) {
+		return
+	}
+	go c.writeDeliveries()
+	for {
+		var deadline time.Time
+		if c.keepAlive > 0 {
+			// the client has one and a half keep alive periods to send its next packet
+			deadline = time.Now().Add(c.keepAlive * 3 / 2)
+		}
+		c.netConn.SetReadDeadline(deadline)
+		p, err := readPacket(r, c.server.MaxPacketSize)
+		if err != nil || !c.handle(p) {
+			return
+		}
+	}
+}
+
+// connect answers the CONNECT, it returns false when the connection is refused
+func (c *conn) connect(p packet) bool {
+	request, err := parseConnect(p.body)
+	if err != nil {
+		return false
+	}
+	if request.protocolName != "MQTT" || request.level != protocolLevel {
+		c.write(connackPacket, 0, []byte{0, connectBadProtocolVersion})
+		return false
+	}
+	if request.will != nil && (!validTopicName(request.will.topic) || request.will.qos > 2) {
+		return false
+	}
+	if request.clientId == "" {
+		if !request.cleanSession {
+			c.write(connackPacket, 0, []byte{0, connectIdentifierRejected})
+			return false
+		}
+		c.server.mu.Lock()
+		c.server.nextId++
+		request.clientId = fmt.Sprintf("pubysuby-%d", c.server.nextId)
+		c.server.mu.Unlock()
+	}
+	if c.server.Authenticate != nil && !c.server.Authenticate(request.clientId, request.username, request.password) {
+		c.write(connackPacket, 0, []byte{0, connectBadUsernamePassword})
+		return false
+	}
+	c.clientId = request.clientId
+	c.will = request.will
+	c.keepAlive = time.Duration(request.keepAlive) * time.Second
+
+	c.server.mu.Lock()
+	previous := c.server.clients[c.clientId]
+	c.server.clients[c.clientId] = c
+	c.server.mu.Unlock()
+	if previous != nil {
+		// the client reconnected, its old connection is closed
+		previous.front.Close()
+	}
+	// sessions are not kept, so the session present flag is never set
+	return c.write(connackPacket, 0, []byte{0, connectAccepted}) == nil
+}
+
+// handle answers the packet, it returns false when the connection is to be closed
+func (c *conn) handle(p packet) bool {
+	switch p.kind {
+	case publishPacket:
+		m, packetId, err := parsePublish(p)
+		if err != nil || !validTopicName(m.topic) {
+			return false
+		}
+		switch m.qos {
+		case 1:
+			c.publish(m)
+			return c.write(pubackPacket, 0, appendUint16(nil, packetId)) == nil
+		case 2:
+			// a PUBLISH sent again before the PUBREL is not published again
+			if !c.received[packetId] {
+				c.received[packetId] = true
+				c.publish(m)
+			}
+			return c.write(pubrecPacket, 0, appendUint16(nil, packetId)) == nil
+		}
+		c.publish(m)
+	case pubrelPacket:
+		d := &decoder{body: p.body}
+		packetId := d.readUint16()
+		if d.err != nil || p.flags != pubrelFlags {
+			return false
+		}
+		delete(c.received, packetId)
+		return c.write(pubcompPacket, 0, appendUint16(nil, packetId)) == nil
+	case pubackPacket:
+		d := &decoder{body: p.body}
+		packetId := d.readUint16()
+		if d.err != nil {
+			return false
+		}
+		select {
+		case c.acks <- packetId:
+		case <-c.front.Done():
+		}
+	case subscribePacket:
+		return c.subscribe(p)
+	case unsubscribePacket:
+		return c.unsubscribe(p)
+	case pingreqPacket:
+		return c.write(pingrespPacket, 0, nil) == nil
+	case disconnectPacket:
+		// a clean disconnect discards the will
+		c.will = nil
+		return false
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *conn) publish(m message) {
+	c.server.ps.Topic(m.topic).PushWithOptions(m.payload, pubysuby.PushOptions{Retain: m.retain})
+}
+
+func (c *conn) subscribe(p packet) bool {
+	if p.flags != subscribeFlags {
+		return false
+	}
+	d := &decoder{body: p.body}
+	packetId := d.readUint16()
+	codes := appendUint16(nil, packetId)
+	var started []*filterSubscription
+	for len(d.body) > 0 && d.err == nil {
+		filter, qos := d.readString(), d.readByte()
+		if d.err != nil || qos > 2 {
+			return false
+		}
+		if !validFilter(filter) {
+			codes = append(codes, subscribeFailure)
+			continue
+		}
+		if qos > 1 {
+			qos = 1
+		}
+		// a subscription to the same filter replaces the existing one
+		if existing, ok := c.subscriptions[filter]; ok {
+			close(existing.stop)
+			<-existing.done
+		}
+		s := &filterSubscription{filter: filter, qos: qos, stop: make(chan struct{}), done: make(chan struct{})}
+		c.subscriptions[filter] = s
+		started = append(started, s)
+		codes = append(codes, qos)
+	}
+	if d.err != nil || len(codes) == 2 {
+		return false
+	}
+	if c.write(subackPacket, 0, codes) != nil {
+		return false
+	}
+	// start delivering after the SUBACK, replaying what was published since the SUBSCRIBE
+	since := time.Now()
+	for _, s := range started {
+		go c.watch(s, since)
+	}
+	return true
+}
+
+func (c *conn) unsubscribe(p packet) bool {
+	if p.flags != subscribeFlags {
+		return false
+	}
+	d := &decoder{body: p.body}
+	packetId := d.readUint16()
+	for len(d.body) > 0 && d.err == nil {
+		filter := d.readString()
+		if s, ok := c.subscriptions[filter]; ok {
+			delete(c.subscriptions, filter)
+			close(s.stop)
+			<-s.done
+		}
+	}
+	if d.err != nil {
+		return false
+	}
+	return c.write(unsubackPacket, 0, appendUint16(nil, packetId)) == nil
+}
+
+// watch subscribes to the topics that match the filter as they appear,
+// replaying the messages they received since the time of the SUBSCRIBE
+func (c *conn) watch(s *filterSubscription, since time.Time) {
+	defer close(s.done)
+	subscriptions := make(map[string]*frontend.Subscription)
+	defer func() {
+		for _, sub := range subscriptions {
+			sub.Unsubscribe()
+		}
+	}()
+	var ticks <-chan time.Time
+	if hasWildcards(s.filter) {
+		ticker := time.NewTicker(c.server.PatternInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		var topics []*pubysuby.TopicHandle
+		if ticks == nil {
+			topics = append(topics, c.server.ps.Topic(s.filter))
+		} else {
+			for _, topic := range c.server.ps.Topics() {
+				if matchFilter(s.filter, topic.Name()) {
+					topics = append(topics, topic)
+				}
+			}
+		}
+		for _, topic := range topics {
+			if _, ok := subscriptions[topic.Name()]; ok {
+				continue
+			}
+			sub := frontend.Subscribe(topic)
+			subscriptions[topic.Name()] = sub
+			go c.forward(sub, s.qos, since)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-ticks:
+		}
+	}
+}
+
+// forward queues the subscription's messages, first the messages published since the time,
+// the topic's retained message goes out flagged as retained unless it is one of them
+func (c *conn) forward(sub *frontend.Subscription, qos byte, since time.Time) {
+	replay := frontend.Replay{Match: func(item pubysuby.TopicItem) bool {
+		return !item.CreatedTime.Before(since)
+	}}
+	sub.Forward(replay, func(item pubysuby.TopicItem) {
+		c.front.Deliver(message{topic: sub.Topic.Name(), payload: item.Message, qos: qos, retain: item.Retained})
+	})
+}
+
+// writeDeliveries sends the queued messages while fewer than Window QoS 1 messages are unacknowledged
+func (c *conn) writeDeliveries() {
+	window := c.server.Window
+	if window <= 0 || window > 65535 {
+		window = 65535
+	}
+	inflight := make(map[uint16]bool)
+	var lastPacketId uint16
+	for {
+		deliveries := c.front.Deliveries
+		if len(inflight) >= window {
+			deliveries = nil
+		}
+		select {
+		case <-c.front.Done():
+			return
+		case packetId := <-c.acks:
+			delete(inflight, packetId)
+		case delivery := <-deliveries:
+			m := delivery.(message)
+			var packetId uint16
+			if m.qos > 0 {
+				// the next packet id that is not in flight, 0 is not a valid id
+				for packetId == 0 || inflight[packetId] {
+					lastPacketId++
+					packetId = lastPacketId
+				}
+				inflight[packetId] = true
+			}
+			flags, body := encodePublish(m, packetId)
+			if err := c.write(publishPacket, flags, body); err != nil {
+				c.front.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) write(kind byte, flags byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := writePacket(c.w, kind, flags, body); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
@@ -0,0 +1,278 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend/frontendtest"
+)
+
+type testClient struct {
+	*frontendtest.Conn
+}
+
+func dial(t *testing.T, l net.Listener) *testClient {
+	return &testClient{frontendtest.Dial(t, l)}
+}
+
+// connect sends a CONNECT with a clean session and returns the CONNACK return code
+func (c *testClient) connect(clientId string, will *message) byte {
+	return c.connectLevel(clientId, will, protocolLevel)
+}
+
+func (c *testClient) connectLevel(clientId string, will *message, level byte) byte {
+	flags := byte(connectFlagCleanSession)
+	if will != nil {
+		flags |= connectFlagWill | will.qos<<connectFlagWillQoSShift
+		if will.retain {
+			flags |= connectFlagWillRetain
+		}
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, level, flags)
+	body = appendUint16(body, 30)
+	body = appendString(body, clientId)
+	if will != nil {
+		body = appendString(body, will.topic)
+		body = appendString(body, will.payload)
+	}
+	c.send(connectPacket, 0, body)
+	p := c.receive()
+	if p.kind != connackPacket || len(p.body) != 2 {
+		c.T.Fatalf("Expected a CONNACK, got %+v", p)
+	}
+	return p.body[1]
+}
+
+func (c *testClient) send(kind byte, flags byte, body []byte) {
+	if err := writePacket(c, kind, flags, body); err != nil {
+		c.T.Fatal(err)
+	}
+}
+
+func (c *testClient) receive() packet {
+	p, err := readPacket(c.Reader(), 0)
+	if err != nil {
+		c.T.Fatal(err)
+	}
+	return p
+}
+
+// subscribe subscribes to the filters with the QoS and returns the SUBACK return codes
+func (c *testClient) subscribe(packetId uint16, qos byte, filters ...string) []byte {
+	body := appendUint16(nil, packetId)
+	for _, filter := range filters {
+		body = append(appendString(body, filter), qos)
+	}
+	c.send(subscribePacket, subscribeFlags, body)
+	p := c.receive()
+	if p.kind != subackPacket || len(p.body) < 2 {
+		c.T.Fatalf("Expected a SUBACK, got %+v", p)
+	}
+	frontendtest.Expect(c.T, p.body[:2], appendUint16(nil, packetId))
+	return p.body[2:]
+}
+
+func (c *testClient) publish(m message, packetId uint16) {
+	flags, body := encodePublish(m, packetId)
+	c.send(publishPacket, flags, body)
+}
+
+// receiveMessage reads a PUBLISH and returns it with its packet id
+func (c *testClient) receiveMessage() (message, uint16) {
+	p := c.receive()
+	if p.kind != publishPacket {
+		c.T.Fatalf("Expected a PUBLISH, got %+v", p)
+	}
+	m, packetId, err := parsePublish(p)
+	if err != nil {
+		c.T.Fatal(err)
+	}
+	return m, packetId
+}
+
+func TestPubSub(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.PatternInterval = time.Millisecond * 10
+	l := frontendtest.Listen(t, server)
+
+	ps.Topic("sensors/kitchen/temperature").PushWithOptions("19", pubysuby.PushOptions{Retain: true})
+	subscriber := dial(t, l)
+	frontendtest.Expect(t, subscriber.connect("subscriber", nil), byte(connectAccepted))
+	frontendtest.Expect(t, subscriber.subscribe(1, 2, "sensors/kitchen/temperature", "news/#", "bad/#/filter"), []byte{1, 1, subscribeFailure})
+	m, packetId := subscriber.receiveMessage()
+	frontendtest.Expect(t, m, message{topic: "sensors/kitchen/temperature", payload: "19", qos: 1, retain: true})
+	subscriber.send(pubackPacket, 0, appendUint16(nil, packetId))
+
+	publisher := dial(t, l)
+	frontendtest.Expect(t, publisher.connect("", nil), byte(connectAccepted))
+	publisher.publish(message{topic: "sensors/kitchen/temperature", payload: "21", qos: 1}, 7)
+	p := publisher.receive()
+	frontendtest.Expect(t, p, packet{kind: pubackPacket, body: appendUint16(nil, 7)})
+	m, packetId = subscriber.receiveMessage()
+	frontendtest.Expect(t, m, message{topic: "sensors/kitchen/temperature", payload: "21", qos: 1})
+	subscriber.send(pubackPacket, 0, appendUint16(nil, packetId))
+
+	// a topic created after the SUBSCRIBE is found, and its first message is not lost
+	publisher.publish(message{topic: "news/sport/football", payload: "goal"}, 0)
+	m, packetId = subscriber.receiveMessage()
+	frontendtest.Expect(t, m, message{topic: "news/sport/football", payload: "goal", qos: 1})
+	subscriber.send(pubackPacket, 0, appendUint16(nil, packetId))
+
+	frontendtest.Expect(t, subscriber.subscribe(2, 0, "sensors/+/humidity"), []byte{0})
+	publisher.publish(message{topic: "sensors/attic/humidity", payload: "40"}, 0)
+	m, _ = subscriber.receiveMessage()
+	frontendtest.Expect(t, m, message{topic: "sensors/attic/humidity", payload: "40"})
+
+	subscriber.send(unsubscribePacket, subscribeFlags, appendString(appendUint16(nil, 3), "sensors/kitchen/temperature"))
+	frontendtest.Expect(t, subscriber.receive(), packet{kind: unsubackPacket, body: appendUint16(nil, 3)})
+	if subscribers := ps.Stats("sensors/kitchen/temperature").Subscribers; subscribers != 0 {
+		t.Errorf("Expected the UNSUBSCRIBE to unsubscribe, got %d subscribers", subscribers)
+	}
+	subscriber.send(pingreqPacket, 0, nil)
+	frontendtest.Expect(t, subscriber.receive(), packet{kind: pingrespPacket, body: []byte{}})
+
+	subscriber.send(disconnectPacket, 0, nil)
+	if _, err := readPacket(subscriber.Reader(), 0); err == nil {
+		t.Errorf("Expected the DISCONNECT to close the connection")
+	}
+	frontendtest.WaitForSubscribers(t, ps, "news/sport/football", 0)
+}
+
+func TestWindow(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.Window = 1
+	l := frontendtest.Listen(t, server)
+
+	client := dial(t, l)
+	frontendtest.Expect(t, client.connect("client", nil), byte(connectAccepted))
+	frontendtest.Expect(t, client.subscribe(1, 1, "orders"), []byte{1})
+	ps.Push("orders", "first")
+	ps.Push("orders", "second")
+	m, packetId := client.receiveMessage()
+	frontendtest.Expect(t, m.payload, "first")
+
+	// the second message waits for the PUBACK of the first
+	client.send(pingreqPacket, 0, nil)
+	frontendtest.Expect(t, client.receive().kind, byte(pingrespPacket))
+	client.send(pubackPacket, 0, appendUint16(nil, packetId))
+	m, _ = client.receiveMessage()
+	frontendtest.Expect(t, m.payload, "second")
+}
+
+func TestWill(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	l := frontendtest.Listen(t, New(ps))
+
+	subscriber := dial(t, l)
+	frontendtest.Expect(t, subscriber.connect("subscriber", nil), byte(connectAccepted))
+	frontendtest.Expect(t, subscriber.subscribe(1, 0, "status/+"), []byte{0})
+
+	// a clean DISCONNECT discards the will
+	polite := dial(t, l)
+	frontendtest.Expect(t, polite.connect("polite", &message{topic: "status/polite", payload: "gone"}), byte(connectAccepted))
+	polite.send(disconnectPacket, 0, nil)
+	readPacket(polite.Reader(), 0)
+
+	device := dial(t, l)
+	frontendtest.Expect(t, device.connect("device", &message{topic: "status/device", payload: "offline", retain: true}), byte(connectAccepted))
+	device.Close()
+	m, _ := subscriber.receiveMessage()
+	frontendtest.Expect(t, m, message{topic: "status/device", payload: "offline"})
+	// the will was published retained, so a new subscription receives it
+	late := dial(t, l)
+	frontendtest.Expect(t, late.connect("late", nil), byte(connectAccepted))
+	frontendtest.Expect(t, late.subscribe(1, 0, "status/device"), []byte{0})
+	m, _ = late.receiveMessage()
+	frontendtest.Expect(t, m, message{topic: "status/device", payload: "offline", retain: true})
+	if last := ps.LastMessageId("status/polite"); last != 0 {
+		t.Errorf("Expected no will after a DISCONNECT, got message %d", last)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.Authenticate = func(clientId string, username string, password string) bool {
+		return clientId != "intruder"
+	}
+	l := frontendtest.Listen(t, server)
+
+	frontendtest.Expect(t, dial(t, l).connectLevel("old", nil, 3), byte(connectBadProtocolVersion))
+	frontendtest.Expect(t, dial(t, l).connect("intruder", nil), byte(connectBadUsernamePassword))
+
+	// a connection with the same client id takes over
+	first := dial(t, l)
+	frontendtest.Expect(t, first.connect("device", nil), byte(connectAccepted))
+	second := dial(t, l)
+	frontendtest.Expect(t, second.connect("device", nil), byte(connectAccepted))
+	if _, err := readPacket(first.Reader(), 0); err == nil {
+		t.Errorf("Expected the first connection to be closed")
+	}
+	second.send(pingreqPacket, 0, nil)
+	frontendtest.Expect(t, second.receive().kind, byte(pingrespPacket))
+}
+
+func TestFilters(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		filter string
+		name   string
+		match  bool
+	}{
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/#", "sport", true},
+		{"sport/#", "sport/tennis/player1", true},
+		{"#", "sport", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, c := range cases {
+		if got := matchFilter(c.filter, c.name); got != c.match {
+			t.Errorf("matchFilter(%q, %q) = %v, expected %v", c.filter, c.name, got, c.match)
+		}
+	}
+	for filter, valid := range map[string]bool{"sport/#": true, "+/+": true, "sport/tennis#": false, "sport/#/ranking": false, "sport+": false, "": false} {
+		if got := validFilter(filter); got != valid {
+			t.Errorf("validFilter(%q) = %v, expected %v", filter, got, valid)
+		}
+	}
+}
+
+func TestPublishQoS2(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	l := frontendtest.Listen(t, New(ps))
+
+	subscriber := dial(t, l)
+	frontendtest.Expect(t, subscriber.connect("subscriber", nil), byte(connectAccepted))
+	frontendtest.Expect(t, subscriber.subscribe(1, 2, "orders"), []byte{1})
+
+	publisher := dial(t, l)
+	frontendtest.Expect(t, publisher.connect("publisher", nil), byte(connectAccepted))
+	order := message{topic: "orders", payload: "one", qos: 2}
+	publisher.publish(order, 9)
+	frontendtest.Expect(t, publisher.receive(), packet{kind: pubrecPacket, body: appendUint16(nil, 9)})
+	// the PUBLISH sent again before the PUBREL is acknowledged without publishing it twice
+	publisher.publish(order, 9)
+	frontendtest.Expect(t, publisher.receive(), packet{kind: pubrecPacket, body: appendUint16(nil, 9)})
+	publisher.send(pubrelPacket, pubrelFlags, appendUint16(nil, 9))
+	frontendtest.Expect(t, publisher.receive(), packet{kind: pubcompPacket, body: appendUint16(nil, 9)})
+
+	m, _ := subscriber.receiveMessage()
+	frontendtest.Expect(t, m, message{topic: "orders", payload: "one", qos: 1})
+	frontendtest.Expect(t, ps.LastMessageId("orders"), int64(1))
+}
@@ -0,0 +1,264 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Control packet types, MQTT 3.1.1 section 2.2.1
+const (
+	connectPacket     = 1
+	connackPacket     = 2
+	publishPacket     = 3
+	pubackPacket      = 4
+	pubrecPacket      = 5
+	pubrelPacket      = 6
+	pubcompPacket     = 7
+	subscribePacket   = 8
+	subackPacket      = 9
+	unsubscribePacket = 10
+	unsubackPacket    = 11
+	pingreqPacket     = 12
+	pingrespPacket    = 13
+	disconnectPacket  = 14
+)
+
+// the protocol level of MQTT 3.1.1
+const protocolLevel = 4
+
+// CONNACK return codes
+const (
+	connectAccepted            = 0
+	connectBadProtocolVersion  = 1
+	connectIdentifierRejected  = 2
+	connectBadUsernamePassword = 4
+)
+
+// the SUBACK return code of a refused subscription
+const subscribeFailure = 0x80
+
+// CONNECT flags
+const (
+	connectFlagReserved     = 0x01
+	connectFlagCleanSession = 0x02
+	connectFlagWill         = 0x04
+	connectFlagWillQoSMask  = 0x18
+	connectFlagWillQoSShift = 3
+	connectFlagWillRetain   = 0x20
+	connectFlagPassword     = 0x40
+	connectFlagUsername     = 0x80
+)
+
+// fixed header flags of PUBLISH, PUBREL and SUBSCRIBE
+const (
+	publishRetain   = 0x01
+	publishQoSMask  = 0x06
+	publishQoSShift = 1
+	pubrelFlags     = 0x02
+	subscribeFlags  = 0x02
+)
+
+// the remaining length is encoded in 7 bits per byte with this continuation bit
+const remainingLengthContinuation = 0x80
+
+// how large a packet the Server accepts unless it says otherwise
+const defaultMaxPacketSize = 1 << 20
+
+// errMalformed is returned for a packet that breaks the protocol, the connection is closed
+var errMalformed = errors.New("mqtt: malformed packet")
+
+// packet is a control packet with its fixed header split into the type and the flags
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads the next packet, refusing packets over maxSize bytes
+func readPacket(r *bufio.Reader, maxSize int) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&^remainingLengthContinuation) * multiplier
+		if b&remainingLengthContinuation == 0 {
+			break
+		}
+		if i == 3 {
+			return packet{}, errMalformed
+		}
+		multiplier *= 128
+	}
+	if maxSize > 0 && length > maxSize {
+		return packet{}, errMalformed
+	}
+	p := packet{kind: header >> 4, flags: header & 0x0f, body: make([]byte, length)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return packet{}, err
+	}
+	return p, nil
+}
+
+// writePacket writes the fixed header and the body
+func writePacket(w io.Writer, kind byte, flags byte, body []byte) error {
+	buf := []byte{kind<<4 | flags&0x0f}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= remainingLengthContinuation
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+func appendUint16(body []byte, n uint16) []byte {
+	return append(body, byte(n>>8), byte(n))
+}
+
+// appendString appends a UTF-8 string or binary data with its uint16 length
+func appendString(body []byte, s string) []byte {
+	return append(appendUint16(body, uint16(len(s))), s...)
+}
+
+// decoder reads the fields of a body in order, after the first error every field reads as zero
+type decoder struct {
+	body []byte
+	err  error
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil || len(d.body) < 1 {
+		d.err = errMalformed
+		return 0
+	}
+	b := d.body[0]
+	d.body = d.body[1:]
+	return b
+}
+
+func (d *decoder) readUint16() uint16 {
+	if d.err != nil || len(d.body) < 2 {
+		d.err = errMalformed
+		return 0
+	}
+	n := binary.BigEndian.Uint16(d.body)
+	d.body = d.body[2:]
+	return n
+}
+
+func (d *decoder) readString() string {
+	n := int(d.readUint16())
+	if d.err != nil || len(d.body) < n {
+		d.err = errMalformed
+		return ""
+	}
+	s := string(d.body[:n])
+	d.body = d.body[n:]
+	return s
+}
+
+// readRest returns the remaining bytes, the payload of a PUBLISH
+func (d *decoder) readRest() string {
+	s := string(d.body)
+	d.body = nil
+	return s
+}
+
+// message is an application message
+type message struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
+}
+
+// connect is a parsed CONNECT packet
+type connect struct {
+	protocolName string
+	level        byte
+	cleanSession bool
+	keepAlive    uint16
+	clientId     string
+	will         *message
+	username     string
+	password     string
+}
+
+func parseConnect(body []byte) (connect, error) {
+	d := &decoder{body: body}
+	var c connect
+	c.protocolName = d.readString()
+	c.level = d.readByte()
+	flags := d.readByte()
+	c.keepAlive = d.readUint16()
+	if d.err != nil || flags&connectFlagReserved != 0 {
+		return c, errMalformed
+	}
+	c.cleanSession = flags&connectFlagCleanSession != 0
+	c.clientId = d.readString()
+	if flags&connectFlagWill != 0 {
+		c.will = &message{
+			topic:  d.readString(),
+			qos:    (flags & connectFlagWillQoSMask) >> connectFlagWillQoSShift,
+			retain: flags&connectFlagWillRetain != 0,
+		}
+		c.will.payload = d.readString()
+	}
+	if flags&connectFlagUsername != 0 {
+		c.username = d.readString()
+	}
+	if flags&connectFlagPassword != 0 {
+		c.password = d.readString()
+	}
+	if d.err != nil {
+		return c, d.err
+	}
+	return c, nil
+}
+
+// parsePublish parses the PUBLISH, its packet id is 0 for QoS 0
+func parsePublish(p packet) (message, uint16, error) {
+	d := &decoder{body: p.body}
+	m := message{
+		topic:  d.readString(),
+		qos:    (p.flags & publishQoSMask) >> publishQoSShift,
+		retain: p.flags&publishRetain != 0,
+	}
+	var packetId uint16
+	if m.qos > 0 {
+		packetId = d.readUint16()
+	}
+	m.payload = d.readRest()
+	if d.err != nil || m.qos > 2 {
+		return m, 0, errMalformed
+	}
+	return m, packetId, nil
+}
+
+// encodePublish returns the fixed header flags and the body of a PUBLISH
+func encodePublish(m message, packetId uint16) (byte, []byte) {
+	flags := m.qos << publishQoSShift
+	if m.retain {
+		flags |= publishRetain
+	}
+	body := appendString(nil, m.topic)
+	if m.qos > 0 {
+		body = appendUint16(body, packetId)
+	}
+	return flags, append(body, m.payload...)
+}
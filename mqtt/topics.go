@@ -0,0 +1,53 @@
+package mqtt
+
+import "strings"
+
+// validTopicName reports whether the name can be published to, it must not be empty or hold wildcards
+func validTopicName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "+#\x00")
+}
+
+// validFilter reports whether the topic filter is well formed:
+// + stands alone in its level and # stands alone in the last level
+func validFilter(filter string) bool {
+	if filter == "" || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+func hasWildcards(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
+
+// matchFilter reports whether the topic name matches the filter,
+// wildcards at the start of a filter do not match the topics starting with $
+func matchFilter(filter string, name string) bool {
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	nameLevels := strings.Split(name, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			// also matches the parent level, "sport/#" matches "sport"
+			return true
+		}
+		if i >= len(nameLevels) {
+			return false
+		}
+		if level != "+" && level != nameLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(nameLevels)
+}
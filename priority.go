@@ -0,0 +1,98 @@
+package pubysuby
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// how many messages a subscriber can fall behind before publishing to the topic waits for it
+const subscriberQueueLength = 256
+
+// how long an unsubscribed subscriber gets to receive the messages published before it unsubscribed
+const unsubscribeGrace = time.Millisecond * 100
+
+// priorityQueue orders messages by descending Priority and ascending MessageId within a priority
+type priorityQueue []TopicItem
+
+func (q priorityQueue) Len() int { return len(q) }
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].MessageId < q[j].MessageId
+}
+func (q priorityQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *priorityQueue) Push(x interface{}) { *q = append(*q, x.(TopicItem)) }
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// sortByPriority orders messages that are already in MessageId order by descending Priority,
+// keeping the MessageId order within a priority
+func sortByPriority(items []TopicItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Priority > items[j].Priority
+	})
+}
+
+// subscriberQueue buffers the messages for a subscriber that is not receiving yet,
+// and hands over the highest priority pending message first
+type subscriberQueue struct {
+	in chan TopicItem
+	// closed when the subscriber unsubscribes
+	stop chan struct{}
+	out  chan []TopicItem
+}
+
+func newSubscriberQueue(out chan []TopicItem) *subscriberQueue {
+	q := &subscriberQueue{in: make(chan TopicItem), stop: make(chan struct{}), out: out}
+	go q.run()
+	return q
+}
+
+// run forwards the messages until stop is closed, then it closes out so the subscriber stops ranging over it.
+// The messages still pending are dropped unless the subscriber receives them within unsubscribeGrace,
+// an unsubscribed subscriber may have stopped receiving and waiting for it would leak the queue.
+func (q *subscriberQueue) run() {
+	var pending priorityQueue
+	defer close(q.out)
+	for {
+		var receive chan TopicItem
+		if pending.Len() < subscriberQueueLength {
+			receive = q.in
+		}
+		var send chan []TopicItem
+		var next []TopicItem
+		if pending.Len() > 0 {
+			send = q.out
+			next = []TopicItem{pending[0]}
+		}
+		select {
+		case <-q.stop:
+			q.flush(pending)
+			return
+		case item := <-receive:
+			heap.Push(&pending, item)
+		case send <- next:
+			heap.Pop(&pending)
+		}
+	}
+}
+
+// flush delivers the pending messages for as long as the subscriber keeps receiving them within the grace period
+func (q *subscriberQueue) flush(pending priorityQueue) {
+	grace := time.NewTimer(unsubscribeGrace)
+	defer grace.Stop()
+	for pending.Len() > 0 {
+		select {
+		case q.out <- []TopicItem{pending[0]}:
+			heap.Pop(&pending)
+		case <-grace.C:
+			return
+		}
+	}
+}
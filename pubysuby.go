@@ -1,26 +1,72 @@
 package pubysuby
 
 import (
-	"log"
+	"sync"
 	"time"
 )
 
 type PubySuby struct {
-	hubRequests   chan hubRequest
-	globalTimeout int64
+	hubRequests       chan hubRequest
+	topicListRequests chan chan []*TopicHandle
+	globalTimeout     int64
+	options           Options
+	budget            *memoryBudget
+	schedule          chan scheduleRequest
+	cancelSchedule    chan cancelRequest
+	clock             *hybridClock
+	// reply topic of Request, created on first use
+	inboxOnce sync.Once
+	inbox     *inbox
+}
+
+// Options configures a PubySuby hub,
+// the zero value means no byte limits and scheduled messages kept in memory only
+type Options struct {
+	// MaxTopicBytes bounds the total message payload bytes retained per topic
+	MaxTopicBytes int
+	// MaxTotalBytes bounds the total message payload bytes retained across all topics
+	MaxTotalBytes int64
+	// EvictionPolicy picks the topic to trim once MaxTotalBytes is exceeded
+	EvictionPolicy EvictionPolicy
+	// ScheduleStore persists the messages scheduled with PushAt and PushAfter, nil keeps them in memory only
+	ScheduleStore ScheduleStore
+	// IdScheme picks how message ids are generated, SequenceIds by default
+	IdScheme IdScheme
+	// SequenceStore persists the per topic sequences of SequenceIds, nil starts every topic at 1
+	SequenceStore SequenceStore
 }
 
 type hubRequest struct {
 	topicName       string
-	hubReplyChannel chan chan topicRequest
+	hubReplyChannel chan chan topicCommand
+	// lookup replies with a nil channel instead of creating a missing topic
+	lookup bool
 }
 
 // New creates a new PubySuby hub and
 // starts a goroutine for handling commands
 func NewPubySuby() *PubySuby {
+	return NewPubySubyWithOptions(Options{})
+}
+
+// NewPubySubyWithOptions creates a new PubySuby hub configured by options
+func NewPubySubyWithOptions(options Options) *PubySuby {
 	ch := make(chan hubRequest)
-	ps := PubySuby{hubRequests: ch, globalTimeout: 30}
+	ps := PubySuby{
+		hubRequests:       ch,
+		topicListRequests: make(chan chan []*TopicHandle),
+		globalTimeout:     30,
+		options:           options,
+		budget:            newMemoryBudget(options.MaxTotalBytes),
+		schedule:          make(chan scheduleRequest),
+		cancelSchedule:    make(chan cancelRequest),
+		clock:             &hybridClock{},
+	}
 	go ps.hubController()
+	go ps.scheduleController()
+	if options.MaxTotalBytes > 0 {
+		go ps.evictionController()
+	}
 	return &ps
 }
 
@@ -33,22 +79,9 @@ type Subscription struct {
 	ListenChannel chan []TopicItem
 }
 
-// Subscribe to all new messages for a topic
-func (ps *PubySuby) Sub(topic string) *Subscription {
-
-	topicCommandChannel := ps.getTopicRequestChannel(topic)
-	////fmt.Println("Received topic channel back")
-	// once we have the topic channel, we have to send it our listener info
-	myListenChannel := make(chan []TopicItem)
-
-	topicCommandChannel <- topicRequest{Cmd: "sub", subscriberListenChannel: myListenChannel}
-
-	result := Subscription{
-		TopicName:     topic,
-		ListenChannel: myListenChannel,
-	}
-	return &result
-
+// Subscribe to all new messages for a topic that pass the filters
+func (ps *PubySuby) Sub(topic string, filters ...Filter) *Subscription {
+	return ps.Topic(topic).Sub(filters...)
 }
 
 //func (ps *PubySuby) SubWithStopChannel(topic string) (chan []TopicItem, chan int) {
@@ -69,123 +102,135 @@ func (ps *PubySuby) Sub(topic string) *Subscription {
 //}
 
 func (ps *PubySuby) Unsubscribe(subscription *Subscription) {
-	topicCommandChannel := ps.getTopicRequestChannel(subscription.TopicName)
-	topicCommandChannel <- topicRequest{Cmd: "unsubscribe", subscriberListenChannel: subscription.ListenChannel}
+	ps.Topic(subscription.TopicName).Unsubscribe(subscription)
 }
 
-// Pull all messages from the specified topic
+// Pull all messages from the specified topic that pass the filters
 // If none are in the topic, blocks for the timeout duration in milliseconds until new message is published
-func (ps *PubySuby) Pull(topic string, timeout int64) []TopicItem {
-	if timeout < 1 {
-		timeout = 1
-	}
-	myListenChannel := make(chan []TopicItem)
-	defer drainRemaining(myListenChannel)
-	topicCommandChannel := ps.getTopicRequestChannel(topic)
-	// once we have the topic channel, we have to send it our listener info
-
-	topicCommandChannel <- topicRequest{Cmd: "pull", subscriberListenChannel: myListenChannel}
-
-	var receivedMessages []TopicItem
-	select {
-	case results, ok := <-myListenChannel:
-		if !ok {
-			log.Fatalf("PullOnceWithTimeout melted down")
-		} else {
-			receivedMessages = results
-		}
-	case <-time.After(time.Millisecond * time.Duration(timeout)):
-		go func() {
-			topicCommandChannel <- topicRequest{Cmd: "unsubscribe", subscriberListenChannel: myListenChannel}
-		}()
-
-	}
-	return receivedMessages
+func (ps *PubySuby) Pull(topic string, timeout int64, filters ...Filter) []TopicItem {
+	return ps.Topic(topic).Pull(timeout, filters...)
 }
 
-// Pull all messages from the specified topic
+// Pull all messages from the specified topic that pass the filters
 // If none are in the topic, blocks for the timeout duration in seconds until new message is published
-func (ps *PubySuby) PullSince(topic string, timeout int64, since int64) []TopicItem {
-	if timeout < 1 {
-		timeout = 1
-	}
-	myListenChannel := make(chan []TopicItem)
-	defer drainRemaining(myListenChannel)
-
-	topicCommandChannel := ps.getTopicRequestChannel(topic)
-	// once we have the topic channel, we have to send it our listener info
-	topicCommandChannel <- topicRequest{Cmd: "pullsince", subscriberListenChannel: myListenChannel, since: since}
-	var receivedMessages []TopicItem
-	select {
-	case results, ok := <-myListenChannel:
-		if !ok {
-			log.Fatal("Blew up during PullSince because myListenChannel was closed")
-		} else {
-			receivedMessages = results
-		}
-	case <-time.After(time.Millisecond * time.Duration(timeout)):
-		go func() {
-			topicCommandChannel <- topicRequest{Cmd: "unsubscribe", subscriberListenChannel: myListenChannel}
-		}()
-		//log.Println(topic, "Timedout")
-	}
-	return receivedMessages
+func (ps *PubySuby) PullSince(topic string, timeout int64, since int64, filters ...Filter) []TopicItem {
+	return ps.Topic(topic).PullSince(timeout, since, filters...)
+}
+
+// Pull the messages published after the cursor, or ErrStaleCursor when the cursor
+// is from another generation of the topic, for example from before the hub restarted
+func (ps *PubySuby) PullSinceCursor(topic string, timeout int64, cursor Cursor, filters ...Filter) ([]TopicItem, error) {
+	return ps.Topic(topic).PullSinceCursor(timeout, cursor, filters...)
 }
 
 // Publishes the message to the topic and returns the message id
 func (ps *PubySuby) Push(topic string, message string) int64 {
-	topicCommandChannel := ps.getTopicRequestChannel(topic)
-	myListenChannel := make(chan []TopicItem)
-	topicCommandChannel <- topicRequest{Cmd: "pub", content: message, subscriberListenChannel: myListenChannel}
-	results, ok := <-myListenChannel
-	if !ok {
-		log.Fatal("Blew up during Push because myListenChannel was closed")
-	}
-	return results[0].MessageId
+	return ps.Topic(topic).Push(message)
 }
 
-// Retrieves the last message posted to the que
-func (ps *PubySuby) LastMessageId(topic string) int64 {
+// Publishes the message to the topic with its own time to live and returns the message id
+func (ps *PubySuby) PushWithTTL(topic string, message string, ttl time.Duration) int64 {
+	return ps.Topic(topic).PushWithTTL(message, ttl)
+}
+
+// Publishes the message unless a message with the same idempotency key was published within the topic's dedup window,
+// returns the message id of the first message published with the key
+func (ps *PubySuby) PushWithMsgId(topic string, msgId string, message string) int64 {
+	return ps.Topic(topic).PushWithMsgId(msgId, message)
+}
 
-	topicCommandChannel := ps.getTopicRequestChannel(topic)
-	////fmt.Println("Received topic channel back")
-	// once we have the topic channel, we have to send it our listener info
-	myListenChannel := make(chan []TopicItem)
+// Publishes the message only if the topic's last message id is expectedLastId,
+// otherwise returns an error wrapping ErrConflict
+func (ps *PubySuby) PushIfLast(topic string, message string, expectedLastId int64) (int64, error) {
+	return ps.Topic(topic).PushIfLast(message, expectedLastId)
+}
 
-	topicCommandChannel <- topicRequest{Cmd: "lastMessageId", subscriberListenChannel: myListenChannel}
+// Publishes the message with the options and returns the message id
+func (ps *PubySuby) PushWithOptions(topic string, message string, options PushOptions) (int64, error) {
+	return ps.Topic(topic).PushWithOptions(message, options)
+}
 
-	results, ok := <-myListenChannel
-	if !ok {
-		log.Fatal("Blew up during LastMessageId because myListenChannel was closed")
-	}
-	return results[0].MessageId
+// Publishes the message with a priority, pending messages of higher priority are delivered first
+func (ps *PubySuby) PushWithPriority(topic string, message string, priority int) int64 {
+	return ps.Topic(topic).PushWithPriority(message, priority)
+}
+
+// Publishes the message with headers that filters can match on and returns the message id
+func (ps *PubySuby) PushWithHeaders(topic string, headers map[string]string, message string) int64 {
+	return ps.Topic(topic).PushWithHeaders(headers, message)
+}
 
+// Publishes the message as the latest value of the key and returns the message id
+func (ps *PubySuby) PushWithKey(topic string, key string, message string) int64 {
+	return ps.Topic(topic).PushWithKey(key, message)
+}
+
+// Publishes the message and keeps it as the topic's retained message for new subscribers and pullers
+func (ps *PubySuby) PushRetained(topic string, message string) int64 {
+	return ps.Topic(topic).PushRetained(message)
+}
+
+// Publishes a tombstone that deletes the key from a compacted topic and returns the message id
+func (ps *PubySuby) DeleteKey(topic string, key string) int64 {
+	return ps.Topic(topic).DeleteKey(key)
+}
+
+// Applies the options to the topic, creating the topic if needed
+func (ps *PubySuby) ConfigureTopic(topic string, options TopicOptions) {
+	ps.Topic(topic).Configure(options)
+}
+
+// Retrieves the last message posted to the que
+func (ps *PubySuby) LastMessageId(topic string) int64 {
+	return ps.Topic(topic).LastMessageId()
+}
+
+// Retrieves a snapshot of the topic's message and subscriber counts
+func (ps *PubySuby) Stats(topic string) TopicStats {
+	return ps.Topic(topic).Stats()
 }
 
 func (ps *PubySuby) hubController() {
 	// A topic name has a channel that can exchange topic commands
 
 	topics := make(map[string]*Topic)
-	for req := range ps.hubRequests {
-
-		// see if a channel for a topic name exists
-		////fmt.Println("Fetch", req.topic)
-		if topics[req.topicName] == nil {
-			// Add the following channel to the topic
-			t := NewTopic(req.topicName)
-			topics[req.topicName] = t
-			// Send new topic channel info to the reply channel
-			req.hubReplyChannel <- t.CommandChannel
-		} else {
-			// Send an existing topic channel to the reply channel
-			req.hubReplyChannel <- topics[req.topicName].CommandChannel
+	for {
+		select {
+		case req := <-ps.hubRequests:
+			// see if a channel for a topic name exists
+			////fmt.Println("Fetch", req.topic)
+			if topics[req.topicName] == nil && req.lookup {
+				req.hubReplyChannel <- nil
+			} else if topics[req.topicName] == nil {
+				// Add the following channel to the topic
+				t := newTopic(req.topicName, ps.options, ps.budget, ps.clock)
+				topics[req.topicName] = t
+				// Send new topic channel info to the reply channel
+				req.hubReplyChannel <- t.CommandChannel
+			} else {
+				// Send an existing topic channel to the reply channel
+				req.hubReplyChannel <- topics[req.topicName].CommandChannel
+			}
+		case reply := <-ps.topicListRequests:
+			handles := make([]*TopicHandle, 0, len(topics))
+			for name, t := range topics {
+				handles = append(handles, &TopicHandle{topicName: name, commandChannel: t.CommandChannel})
+			}
+			reply <- handles
 		}
 	}
 }
 
-func (ps *PubySuby) getTopicRequestChannel(topicName string) chan topicRequest {
+// Topics returns handles for every topic created on the hub so far
+func (ps *PubySuby) Topics() []*TopicHandle {
+	reply := make(chan []*TopicHandle)
+	ps.topicListRequests <- reply
+	return <-reply
+}
+
+func (ps *PubySuby) getTopicRequestChannel(topicName string) chan topicCommand {
 	// Create a reply channel to get channel back that can send commands to the topic controller
-	reply := make(chan chan topicRequest)
+	reply := make(chan chan topicCommand)
 
 	// Send the request to receive our topic
 	ps.hubRequests <- hubRequest{topicName: topicName, hubReplyChannel: reply}
@@ -1,10 +1,18 @@
 package pubysuby
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -275,3 +283,975 @@ func TestPullSinceAndGC(t *testing.T) {
 	}()
 	<-time.After(time.Second * 5)
 }
+
+func TestTopicHandle(t *testing.T) {
+	t.Parallel()
+	runtime.GOMAXPROCS(16)
+
+	ps := NewPubySuby()
+	topic := ps.Topic("TestTopicHandle")
+
+	subscription := topic.Sub()
+	received := make(chan []TopicItem)
+	go func() {
+		for messages := range subscription.ListenChannel {
+			received <- messages
+		}
+	}()
+
+	firstId := topic.Push("one")
+	if messages := <-received; messages[0].Message != "one" {
+		t.Error("Expected one got ", messages[0].Message)
+	}
+	lastId := ps.Push("TestTopicHandle", "two")
+	<-received
+	if topic.LastMessageId() != lastId {
+		t.Errorf("Expected last message id %d, got %d", lastId, topic.LastMessageId())
+	}
+
+	messages := topic.PullSince(1000, firstId)
+	if len(messages) != 1 || messages[0].Message != "two" {
+		t.Error("Expected to pull message two, got ", messages)
+	}
+
+	stats := topic.Stats()
+	if stats.Messages != 2 || stats.Subscribers != 1 || stats.LastMessageId != lastId {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	topic.Unsubscribe(subscription)
+	if stats := ps.Stats("TestTopicHandle"); stats.Subscribers != 0 {
+		t.Errorf("Expected no subscribers after unsubscribe, got %d", stats.Subscribers)
+	}
+}
+
+func TestLookupTopic(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	if _, ok := ps.LookupTopic("TestLookupTopic"); ok {
+		t.Error("Expected no handle for a missing topic")
+	}
+	if len(ps.Topics()) != 0 {
+		t.Error("Expected the lookup not to create the topic")
+	}
+	id := ps.Push("TestLookupTopic", "one")
+	topic, ok := ps.LookupTopic("TestLookupTopic")
+	if !ok || topic.LastMessageId() != id {
+		t.Error("Expected a handle for the existing topic, got ", topic, ok)
+	}
+}
+
+type unknownCommand struct {
+	rejected chan error
+}
+
+func (cmd unknownCommand) reject(err error) {
+	cmd.rejected <- err
+}
+
+func TestUnknownCommandRejected(t *testing.T) {
+	t.Parallel()
+
+	topic := NewTopic("TestUnknownCommandRejected")
+	rejected := make(chan error)
+	topic.CommandChannel <- unknownCommand{rejected: rejected}
+	if err := <-rejected; !errors.Is(err, ErrUnknownCommand) {
+		t.Error("Expected ErrUnknownCommand, got ", err)
+	}
+}
+
+func TestRejectedCommandsReturn(t *testing.T) {
+	t.Parallel()
+
+	commands := make(chan topicCommand)
+	defer close(commands)
+	go func() {
+		for cmd := range commands {
+			cmd.reject(ErrUnknownCommand)
+		}
+	}()
+	topic := &TopicHandle{topicName: "TestRejectedCommandsReturn", commandChannel: commands}
+	if messages := topic.PullSince(1000, 0); len(messages) != 0 {
+		t.Error("Expected no messages from a rejected pull, got ", messages)
+	}
+	if _, err := topic.PullSinceCursor(1000, Cursor{}); !errors.Is(err, ErrUnknownCommand) {
+		t.Error("Expected the cursor pull to return the rejection, got ", err)
+	}
+	if id := topic.Push("one"); id != 0 {
+		t.Error("Expected no id for a rejected push, got ", id)
+	}
+	if _, err := topic.PushIfLast("one", 0); !errors.Is(err, ErrUnknownCommand) {
+		t.Error("Expected PushIfLast to return the rejection, got ", err)
+	}
+	if id := topic.LastMessageId(); id != 0 {
+		t.Error("Expected no last message id, got ", id)
+	}
+	if stats := topic.Stats(); stats.TopicName != "TestRejectedCommandsReturn" || stats.Messages != 0 {
+		t.Error("Expected empty stats, got ", stats)
+	}
+	if page := topic.History(HistoryQuery{}); len(page.Items) != 0 || page.Next != 0 {
+		t.Error("Expected an empty history page, got ", page)
+	}
+}
+
+func TestTrimToMaxAgeRemovesEveryExpiredItem(t *testing.T) {
+	t.Parallel()
+
+	topic := &Topic{item_max_age: 1, maxItemsLength: 100, messages: list.New()}
+	expired := time.Now().Add(-time.Second * 5)
+	for i := int64(0); i < 10; i++ {
+		topic.messages.PushBack(TopicItem{MessageId: i, CreatedTime: expired})
+	}
+	topic.messages.PushBack(TopicItem{MessageId: 10, CreatedTime: time.Now()})
+
+	topic.GC()
+	if topic.messages.Len() != 1 {
+		t.Errorf("Expected 1 message to survive GC, got %d", topic.messages.Len())
+	}
+}
+
+func TestBoundedUnderContinuousPublish(t *testing.T) {
+	t.Parallel()
+	runtime.GOMAXPROCS(16)
+
+	ps := NewPubySuby()
+	topic := ps.Topic("TestBoundedUnderContinuousPublish")
+	// publish without pause for longer than the GC interval
+	deadline := time.Now().Add(gcInterval * 2)
+	for i := 0; time.Now().Before(deadline); i++ {
+		topic.Push(strconv.Itoa(i))
+		if i%1000 == 0 {
+			if stats := topic.Stats(); stats.Messages > 100 {
+				t.Fatalf("Expected at most 100 retained messages, got %d", stats.Messages)
+			}
+		}
+	}
+	if stats := topic.Stats(); stats.Messages > 100 {
+		t.Errorf("Expected at most 100 retained messages, got %d", stats.Messages)
+	}
+}
+
+func TestMaxTopicBytes(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySubyWithOptions(Options{MaxTopicBytes: 10})
+	topic := ps.Topic("TestMaxTopicBytes")
+	for i := 0; i < 5; i++ {
+		topic.Push("1234")
+	}
+	stats := topic.Stats()
+	if stats.Bytes != 8 || stats.Messages != 2 {
+		t.Errorf("Expected 2 messages holding 8 bytes, got %d holding %d", stats.Messages, stats.Bytes)
+	}
+	if hubStats := ps.HubStats(); hubStats.Bytes != 8 {
+		t.Errorf("Expected the hub to account for 8 bytes, got %d", hubStats.Bytes)
+	}
+}
+
+func TestMaxTotalBytesEviction(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []EvictionPolicy{EvictOldest, EvictLargestTopic} {
+		ps := NewPubySubyWithOptions(Options{MaxTotalBytes: 100, EvictionPolicy: policy})
+		ps.Push("old", strings.Repeat("o", 40))
+		ps.Push("big", strings.Repeat("b", 30))
+		ps.Push("big", strings.Repeat("b", 30))
+		// goes over the budget by 10 bytes
+		ps.Push("new", strings.Repeat("n", 10))
+
+		deadline := time.Now().Add(time.Second)
+		for ps.HubStats().Bytes > 100 && time.Now().Before(deadline) {
+			<-time.After(time.Millisecond)
+		}
+		if bytes := ps.HubStats().Bytes; bytes > 100 {
+			t.Fatalf("Policy %d: expected the hub to evict down to 100 bytes, got %d", policy, bytes)
+		}
+		old, big := ps.Stats("old"), ps.Stats("big")
+		if policy == EvictOldest && (old.Messages != 0 || big.Messages != 2) {
+			t.Errorf("EvictOldest should have evicted the oldest topic, got old %+v big %+v", old, big)
+		}
+		if policy == EvictLargestTopic && (old.Messages != 1 || big.Messages != 1) {
+			t.Errorf("EvictLargestTopic should have evicted from the largest topic, got old %+v big %+v", old, big)
+		}
+	}
+}
+
+func TestPushWithTTL(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	ps.PushWithTTL("TestPushWithTTL", "typing", time.Millisecond*20)
+	importantId := ps.PushWithTTL("TestPushWithTTL", "important", time.Second*10)
+	<-time.After(time.Millisecond * 50)
+
+	messages := ps.Pull("TestPushWithTTL", 1000)
+	if len(messages) != 1 || messages[0].MessageId != importantId {
+		t.Error("Expected only the important message, got ", messages)
+	}
+	// outlive the default max age and let GC run
+	<-time.After(time.Second*2 + gcInterval)
+	stats := ps.Stats("TestPushWithTTL")
+	if stats.Messages != 1 {
+		t.Errorf("Expected the important message to be retained past the max age, got %d messages", stats.Messages)
+	}
+}
+
+func TestCompactedTopic(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	ps.ConfigureTopic("TestCompactedTopic", TopicOptions{Compacted: true})
+	prices := ps.Topic("TestCompactedTopic")
+	prices.PushWithKey("AAPL", "100")
+	prices.PushWithKey("MSFT", "200")
+	prices.PushWithKey("AAPL", "101")
+	prices.DeleteKey("MSFT")
+	prices.Push("market open")
+
+	// outlive the default max age and let GC run
+	<-time.After(time.Second*2 + gcInterval)
+
+	state := make(map[string]string)
+	for _, item := range prices.PullSince(1000, 0) {
+		if item.Tombstone {
+			delete(state, item.Key)
+		} else if item.Key != "" {
+			state[item.Key] = item.Message
+		} else {
+			t.Error("Expected the keyless message to expire, got ", item.Message)
+		}
+	}
+	if len(state) != 1 || state["AAPL"] != "101" {
+		t.Error("Expected only the latest AAPL price, got ", state)
+	}
+}
+
+func TestPushRetained(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	retainedId := ps.PushRetained("TestPushRetained", "online")
+	ps.Push("TestPushRetained", "chatter")
+	// outlive the default max age and let GC trim the history
+	<-time.After(time.Second*2 + gcInterval)
+
+	subscription := ps.Sub("TestPushRetained")
+	select {
+	case messages := <-subscription.ListenChannel:
+		if messages[0].MessageId != retainedId || messages[0].Message != "online" || !messages[0].Retained {
+			t.Error("Expected the retained message on subscribe, got ", messages)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the retained message on subscribe, got nothing")
+	}
+	ps.Unsubscribe(subscription)
+
+	messages := ps.Pull("TestPushRetained", 1000)
+	if len(messages) != 1 || messages[0].MessageId != retainedId || !messages[0].Retained {
+		t.Error("Expected to pull the retained message, got ", messages)
+	}
+	if messages := ps.PullSince("TestPushRetained", 1, retainedId); len(messages) != 0 {
+		t.Error("Expected nothing since the retained message, got ", messages)
+	}
+
+	ps.PushRetained("TestPushRetained", "")
+	nextId := ps.Push("TestPushRetained", "chatter")
+	if messages := ps.Pull("TestPushRetained", 1000); len(messages) != 2 || messages[1].MessageId != nextId || messages[0].Retained || messages[1].Retained {
+		t.Error("Expected the cleared retained message and chatter, got ", messages)
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	responder := ps.Respond("TestRequestReply", func(request TopicItem) (string, error) {
+		if request.Message == "fail" {
+			return "", errors.New("cannot do that")
+		}
+		return "hello " + request.Message, nil
+	})
+	defer responder.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := ps.Request(ctx, "TestRequestReply", "bob")
+	if err != nil || reply.Message != "hello bob" {
+		t.Error("Expected hello bob, got ", reply.Message, err)
+	}
+	if _, err := ps.Request(ctx, "TestRequestReply", "fail"); !errors.Is(err, ErrResponderFailed) {
+		t.Error("Expected ErrResponderFailed, got ", err)
+	}
+
+	noResponders, cancelNoResponders := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancelNoResponders()
+	if _, err := ps.Request(noResponders, "TestRequestReplyNobody", "hello"); err != context.DeadlineExceeded {
+		t.Error("Expected a timeout without responders, got ", err)
+	}
+}
+
+func TestRequestScatterGather(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	for i := 0; i < 3; i++ {
+		name := strconv.Itoa(i)
+		responder := ps.Respond("TestRequestScatterGather", func(request TopicItem) (string, error) {
+			return name, nil
+		})
+		defer responder.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	replies, err := ps.RequestMany(ctx, "TestRequestScatterGather", "who is there", 3)
+	if err != nil || len(replies) != 3 {
+		t.Error("Expected 3 replies, got ", len(replies), err)
+	}
+
+	gather, cancelGather := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancelGather()
+	replies, err = ps.RequestMany(gather, "TestRequestScatterGather", "who is there", 0)
+	if err != nil || len(replies) != 3 {
+		t.Error("Expected to gather 3 replies until the deadline, got ", len(replies), err)
+	}
+}
+
+func TestPushAfter(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	ps.PushAfter("TestPushAfter", "second", time.Millisecond*200)
+	ps.PushAt("TestPushAfter", "first", time.Now().Add(time.Millisecond*100))
+	ps.PushAfter("TestPushAfter", "overdue", -time.Second)
+
+	if messages := ps.Pull("TestPushAfter", 1000); len(messages) != 1 || messages[0].Message != "overdue" {
+		t.Fatal("Expected the overdue message right away, got ", messages)
+	}
+	if lastId := ps.LastMessageId("TestPushAfter"); lastId != 1 {
+		t.Errorf("Expected the scheduled messages to have no message id yet, last id is %d", lastId)
+	}
+	<-time.After(time.Millisecond * 300)
+	messages := ps.Pull("TestPushAfter", 1000)
+	if len(messages) != 3 || messages[1].Message != "first" || messages[2].Message != "second" {
+		t.Error("Expected the scheduled messages in delivery order, got ", messages)
+	}
+}
+
+func TestFileScheduleStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pubysuby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedule.json")
+
+	ps := NewPubySubyWithOptions(Options{ScheduleStore: NewFileScheduleStore(path)})
+	ps.PushAfter("TestFileScheduleStore", "later", time.Millisecond*300)
+	ps.PushAfter("TestFileScheduleStore", "sooner", time.Millisecond*100)
+	<-time.After(time.Millisecond * 200)
+
+	// a new hub picks up what the first one did not deliver yet
+	restarted := NewPubySubyWithOptions(Options{ScheduleStore: NewFileScheduleStore(path)})
+	messages := restarted.Pull("TestFileScheduleStore", 1000)
+	if len(messages) != 1 || messages[0].Message != "later" {
+		t.Error("Expected the restarted hub to deliver the pending message, got ", messages)
+	}
+}
+
+func TestScheduleIdsAfterRestart(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pubysuby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedule.json")
+
+	store := NewFileScheduleStore(path)
+	ps := NewPubySubyWithOptions(Options{ScheduleStore: store})
+	deliveredId := ps.PushAfter("TestScheduleIdsAfterRestart", "delivered", time.Millisecond*10)
+	ps.Pull("TestScheduleIdsAfterRestart", 1000)
+	deadline := time.Now().Add(time.Second * 5)
+	for messages, _ := store.Load(); len(messages) != 0; messages, _ = store.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the delivered message to be deleted from the store")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the restarted hub does not hand out the id of the delivered message again
+	restarted := NewPubySubyWithOptions(Options{ScheduleStore: NewFileScheduleStore(path)})
+	if id := restarted.PushAfter("TestScheduleIdsAfterRestart", "new", time.Hour); id <= deliveredId {
+		t.Errorf("Expected an id after %d, got %d", deliveredId, id)
+	}
+	if restarted.Cancel(deliveredId) {
+		t.Error("Expected the id of the delivered message not to cancel the new one")
+	}
+}
+
+func TestCancelScheduled(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	keptId := ps.PushAfter("TestCancelScheduled", "kept", time.Millisecond*100)
+	cancelledId := ps.PushAfter("TestCancelScheduled", "cancelled", time.Millisecond*100)
+	if keptId == cancelledId {
+		t.Fatal("Expected every scheduled message to get its own id, got ", keptId)
+	}
+	if !ps.Cancel(cancelledId) {
+		t.Error("Expected the pending message to be cancelled")
+	}
+	if ps.Cancel(cancelledId) {
+		t.Error("Expected the message to be cancelled only once")
+	}
+	messages := ps.Pull("TestCancelScheduled", 1000)
+	if len(messages) != 1 || messages[0].Message != "kept" {
+		t.Error("Expected only the kept message, got ", messages)
+	}
+	if ps.Cancel(keptId) {
+		t.Error("Expected a published message not to be cancelled")
+	}
+}
+
+func TestScheduleBlockedTopic(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	// hold the topic the way a transaction does, so pushing to it blocks
+	holderChannel := make(chan topicCommand)
+	locked := make(chan struct{})
+	ps.getTopicRequestChannel("TestScheduleBlockedTopic/blocked") <- lockCommand{holderChannel: holderChannel, locked: locked}
+	<-locked
+
+	ps.PushAfter("TestScheduleBlockedTopic/blocked", "first", -time.Second)
+	ps.PushAfter("TestScheduleBlockedTopic/blocked", "second", -time.Second)
+	ps.PushAfter("TestScheduleBlockedTopic/free", "free", -time.Second)
+	if messages := ps.Pull("TestScheduleBlockedTopic/free", 1000); len(messages) != 1 {
+		t.Error("Expected a blocked topic not to hold up the other topics, got ", messages)
+	}
+	close(holderChannel)
+	deadline := time.Now().Add(time.Second * 5)
+	for ps.LastMessageId("TestScheduleBlockedTopic/blocked") < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	messages := ps.PullSince("TestScheduleBlockedTopic/blocked", 1000, 0)
+	if len(messages) != 2 || messages[0].Message != "first" || messages[1].Message != "second" {
+		t.Error("Expected the blocked topic's messages in order once it is released, got ", messages)
+	}
+}
+
+func TestFileScheduleStoreCompaction(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pubysuby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedule.json")
+
+	store := NewFileScheduleStore(path)
+	pending := ScheduledMessage{Id: 1, Topic: "TestFileScheduleStoreCompaction", Message: "pending", At: time.Now().Add(time.Hour)}
+	if err := store.Save(pending); err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(2); id < 200; id++ {
+		message := ScheduledMessage{Id: id, Topic: "TestFileScheduleStoreCompaction", Message: "delivered"}
+		if err := store.Save(message); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > minCompactLines {
+		t.Errorf("Expected the log to be compacted, it has %d lines", lines)
+	}
+
+	// a torn last line is ignored
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Message":{"Id":20`)
+	file.Close()
+	reloaded := NewFileScheduleStore(path)
+	messages, err := reloaded.Load()
+	if err != nil || len(messages) != 1 || messages[0].Message != "pending" {
+		t.Error("Expected only the pending message after a reload, got ", messages, err)
+	}
+	if lastId, err := reloaded.LastId(); err != nil || lastId != 199 {
+		t.Error("Expected the last id to survive the compaction, got ", lastId, err)
+	}
+	// the next change does not append after the torn line
+	if err := reloaded.Save(ScheduledMessage{Id: 200, Topic: "TestFileScheduleStoreCompaction", Message: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := NewFileScheduleStore(path).Load(); err != nil || len(messages) != 2 {
+		t.Error("Expected the pending and the new message, got ", messages, err)
+	}
+}
+
+func TestPriorityLanes(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	subscription := ps.Sub("TestPriorityLanes")
+	firstId := ps.PushWithPriority("TestPriorityLanes", "bulk 1", 0)
+	ps.PushWithPriority("TestPriorityLanes", "bulk 2", 0)
+	ps.PushWithPriority("TestPriorityLanes", "alert", 10)
+	// the topic controller has queued the messages once it answers the next command
+	ps.LastMessageId("TestPriorityLanes")
+
+	var received []string
+	for i := 0; i < 3; i++ {
+		messages := <-subscription.ListenChannel
+		received = append(received, messages[0].Message)
+	}
+	if strings.Join(received, ",") != "alert,bulk 1,bulk 2" {
+		t.Error("Expected the alert first and the bulk messages in order, got ", received)
+	}
+	ps.Unsubscribe(subscription)
+
+	messages := ps.Pull("TestPriorityLanes", 1000)
+	if len(messages) != 3 || messages[0].Message != "alert" || messages[1].Message != "bulk 1" {
+		t.Error("Expected Pull to return the alert first, got ", messages)
+	}
+	// resuming from the last message of a batch neither skips nor repeats one
+	messages = ps.PullSince("TestPriorityLanes", 1000, firstId)
+	if len(messages) != 2 || messages[0].Message != "bulk 2" || messages[1].Message != "alert" {
+		t.Error("Expected PullSince to keep the message id order, got ", messages)
+	}
+	if messages := ps.PullSince("TestPriorityLanes", 1000, messages[0].MessageId); len(messages) != 1 || messages[0].Message != "alert" {
+		t.Error("Expected only the alert after bulk 2, got ", messages)
+	}
+}
+
+func TestUnsubscribeWithBacklog(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	subscription := ps.Sub("TestUnsubscribeWithBacklog")
+	for i := 0; i < 100; i++ {
+		ps.Push("TestUnsubscribeWithBacklog", strconv.Itoa(i))
+	}
+	ps.Unsubscribe(subscription)
+	// the subscriber stops receiving, after the grace period the backlog is dropped
+	<-time.After(unsubscribeGrace * 5)
+	received := 0
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case _, ok := <-subscription.ListenChannel:
+			if !ok {
+				if received == 100 {
+					t.Error("Expected the unread backlog to be dropped")
+				}
+				return
+			}
+			received++
+		case <-timeout:
+			t.Fatal("Expected the listen channel to close after Unsubscribe")
+		}
+	}
+}
+
+func TestPushWithMsgId(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	ps.ConfigureTopic("TestPushWithMsgId", TopicOptions{DedupWindow: time.Millisecond * 100})
+	firstId := ps.PushWithMsgId("TestPushWithMsgId", "order-1", "created")
+	if retryId := ps.PushWithMsgId("TestPushWithMsgId", "order-1", "created"); retryId != firstId {
+		t.Errorf("Expected the retry to return message id %d, got %d", firstId, retryId)
+	}
+	if stats := ps.Stats("TestPushWithMsgId"); stats.Messages != 1 {
+		t.Errorf("Expected the retry not to be appended, got %d messages", stats.Messages)
+	}
+	if otherId := ps.PushWithMsgId("TestPushWithMsgId", "order-2", "created"); otherId == firstId {
+		t.Error("Expected a different idempotency key to be published")
+	}
+
+	<-time.After(time.Millisecond * 150)
+	if laterId := ps.PushWithMsgId("TestPushWithMsgId", "order-1", "created"); laterId == firstId {
+		t.Error("Expected the idempotency key to be forgotten after the dedup window")
+	}
+}
+
+func TestPushIfLast(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	lastId := ps.LastMessageId("TestPushIfLast")
+	createdId, err := ps.PushIfLast("TestPushIfLast", "created", lastId)
+	if err != nil {
+		t.Fatal("Expected the first event to be appended, got ", err)
+	}
+	// a concurrent writer that read the same last id loses
+	if _, err := ps.PushIfLast("TestPushIfLast", "created again", lastId); !errors.Is(err, ErrConflict) {
+		t.Error("Expected ErrConflict, got ", err)
+	}
+	if _, err := ps.PushIfLast("TestPushIfLast", "shipped", createdId); err != nil {
+		t.Error("Expected the next event to be appended, got ", err)
+	}
+	if stats := ps.Stats("TestPushIfLast"); stats.Messages != 2 {
+		t.Errorf("Expected 2 events in the stream, got %d", stats.Messages)
+	}
+}
+
+func TestTxCommitIsAtomic(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	done := make(chan int)
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			tx := ps.Tx()
+			tx.Push("TestTxOrders", "order "+strconv.Itoa(i))
+			tx.Push("TestTxAudit", "audit "+strconv.Itoa(i))
+			if _, err := tx.Commit(); err != nil {
+				t.Error("Commit failed: ", err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if ps.LastMessageId("TestTxOrders") != ps.LastMessageId("TestTxAudit") {
+				t.Error("Expected both topics to have every committed message")
+			}
+			return
+		default:
+		}
+		// whichever topic is read first, the other one already has at least as many messages
+		orders := ps.LastMessageId("TestTxOrders")
+		if audit := ps.LastMessageId("TestTxAudit"); audit < orders {
+			t.Fatalf("Saw order %d without its audit, audit is at %d", orders, audit)
+		}
+		audit := ps.LastMessageId("TestTxAudit")
+		if orders := ps.LastMessageId("TestTxOrders"); orders < audit {
+			t.Fatalf("Saw audit %d without its order, orders is at %d", audit, orders)
+		}
+	}
+}
+
+func TestTxCommitIsAtomicForSubscribers(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	orders := ps.Sub("TestTxSubOrders")
+	audit := ps.Sub("TestTxSubAudit")
+
+	// hold both topics the way Commit does, nothing is delivered while a topic is held
+	holders := make(map[string]chan topicCommand)
+	for _, name := range []string{"TestTxSubAudit", "TestTxSubOrders"} {
+		holders[name] = make(chan topicCommand)
+		locked := make(chan struct{})
+		ps.getTopicRequestChannel(name) <- lockCommand{holderChannel: holders[name], locked: locked}
+		<-locked
+		holder := TopicHandle{topicName: name, commandChannel: holders[name]}
+		holder.Push("held")
+	}
+	select {
+	case messages := <-orders.ListenChannel:
+		t.Fatal("Expected no delivery while the topics are held, got ", messages)
+	case messages := <-audit.ListenChannel:
+		t.Fatal("Expected no delivery while the topics are held, got ", messages)
+	case <-time.After(time.Millisecond * 50):
+	}
+	for _, holderChannel := range holders {
+		close(holderChannel)
+	}
+	for _, subscription := range []*Subscription{orders, audit} {
+		select {
+		case messages := <-subscription.ListenChannel:
+			if messages[0].Message != "held" {
+				t.Error("Expected the held message once the topic is released, got ", messages)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Expected the held message once the topic is released")
+		}
+	}
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			tx := ps.Tx()
+			tx.Push("TestTxSubOrders", "order "+strconv.Itoa(i))
+			tx.Push("TestTxSubAudit", "audit "+strconv.Itoa(i))
+			tx.Commit()
+		}
+	}()
+	// whichever topic delivers first, the other one already has the message
+	for received := 0; received < 200; received++ {
+		select {
+		case messages := <-orders.ListenChannel:
+			if last := ps.LastMessageId("TestTxSubAudit"); last < messages[0].MessageId {
+				t.Fatalf("Received order %d before its audit was committed, audit is at %d", messages[0].MessageId, last)
+			}
+		case messages := <-audit.ListenChannel:
+			if last := ps.LastMessageId("TestTxSubOrders"); last < messages[0].MessageId {
+				t.Fatalf("Received audit %d before its order was committed, orders is at %d", messages[0].MessageId, last)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Expected every committed message, received ", received)
+		}
+	}
+	ps.Unsubscribe(orders)
+	ps.Unsubscribe(audit)
+}
+
+func TestTxRollback(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	tx := ps.Tx()
+	tx.Push("TestTxRollback", "discarded")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != ErrTxDone {
+		t.Error("Expected ErrTxDone committing a rolled back transaction, got ", err)
+	}
+	if messages := ps.Pull("TestTxRollback", 1); len(messages) != 0 {
+		t.Error("Expected nothing published after rollback, got ", messages)
+	}
+}
+
+func TestStaleCursorAfterRestart(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	if firstId := ps.Push("TestStaleCursor", "one"); firstId != 1 {
+		t.Errorf("Expected the first message id to be 1, got %d", firstId)
+	}
+	ps.Push("TestStaleCursor", "two")
+	messages, err := ps.PullSinceCursor("TestStaleCursor", 1000, Cursor{})
+	if err != nil || len(messages) != 2 {
+		t.Fatal("Expected to pull both messages from the zero cursor, got ", messages, err)
+	}
+	cursor := messages[1].Cursor()
+
+	restarted := NewPubySuby()
+	restarted.Push("TestStaleCursor", "three")
+	restarted.Push("TestStaleCursor", "four")
+	if _, err := restarted.PullSinceCursor("TestStaleCursor", 1, cursor); !errors.Is(err, ErrStaleCursor) {
+		t.Error("Expected ErrStaleCursor for a cursor from before the restart, got ", err)
+	}
+	if _, err := ps.PullSinceCursor("TestStaleCursor", 1, Cursor{Generation: cursor.Generation, MessageId: 5}); !errors.Is(err, ErrStaleCursor) {
+		t.Error("Expected ErrStaleCursor for a cursor past the last message id, got ", err)
+	}
+}
+
+func TestFileSequenceStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "pubysuby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sequences.json")
+
+	ps := NewPubySubyWithOptions(Options{SequenceStore: NewFileSequenceStore(path)})
+	lastId := ps.Push("TestFileSequenceStore", "before restart")
+	messages, _ := ps.PullSinceCursor("TestFileSequenceStore", 1000, Cursor{})
+	cursor := messages[0].Cursor()
+
+	restarted := NewPubySubyWithOptions(Options{SequenceStore: NewFileSequenceStore(path)})
+	if nextId := restarted.Push("TestFileSequenceStore", "after restart"); nextId <= lastId {
+		t.Errorf("Expected the message id to keep increasing after the restart, got %d after %d", nextId, lastId)
+	}
+	messages, err = restarted.PullSinceCursor("TestFileSequenceStore", 1000, cursor)
+	if err != nil || len(messages) != 1 || messages[0].Message != "after restart" {
+		t.Error("Expected the cursor to stay valid after the restart, got ", messages, err)
+	}
+}
+
+func TestClockIdsCursorAfterRestart(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySubyWithOptions(Options{IdScheme: ClockIds})
+	ps.Push("TestClockIdsCursorAfterRestart", "before restart")
+	messages, _ := ps.PullSinceCursor("TestClockIdsCursorAfterRestart", 1000, Cursor{})
+	cursor := messages[0].Cursor()
+
+	// the clock ids of a run start at the wall clock millisecond it publishes in,
+	// a real restart takes longer than the millisecond this waits
+	time.Sleep(time.Millisecond * 2)
+	// the restarted hub has not published to the topic yet, so nothing is newer than the cursor
+	restarted := NewPubySubyWithOptions(Options{IdScheme: ClockIds})
+	if messages, err := restarted.PullSinceCursor("TestClockIdsCursorAfterRestart", 10, cursor); err != nil || len(messages) != 0 {
+		t.Error("Expected the cursor to stay valid with nothing newer, got ", messages, err)
+	}
+	restarted.Push("TestClockIdsCursorAfterRestart", "after restart")
+	messages, err := restarted.PullSinceCursor("TestClockIdsCursorAfterRestart", 1000, cursor)
+	if err != nil || len(messages) != 1 || messages[0].Message != "after restart" {
+		t.Error("Expected the cursor to resume with the message after the restart, got ", messages, err)
+	}
+}
+
+func TestClockIds(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySubyWithOptions(Options{IdScheme: ClockIds})
+	var lastId int64
+	for i := 0; i < 100; i++ {
+		id := ps.Push("TestClockIds"+strconv.Itoa(i%3), "tick")
+		if id <= lastId {
+			t.Fatalf("Expected hub-wide increasing ids, got %d after %d", id, lastId)
+		}
+		lastId = id
+	}
+	if generation := ps.Stats("TestClockIds0").Generation; generation != 0 {
+		t.Errorf("Expected generation 0 with clock ids, got %d", generation)
+	}
+}
+
+func TestPullSinceCursorTrimmed(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	topic := ps.Topic("TestPullSinceCursorTrimmed")
+	topic.Push("seen")
+	messages, _ := topic.PullSinceCursor(1000, Cursor{})
+	cursor := messages[0].Cursor()
+	// push past maxItemsLength so the messages right after the cursor are trimmed
+	for i := 0; i < 150; i++ {
+		topic.Push(strconv.Itoa(i))
+	}
+
+	messages, err := topic.PullSinceCursor(1000, cursor)
+	var trimmed *TrimmedError
+	if !errors.As(err, &trimmed) || !errors.Is(err, ErrCursorTrimmed) {
+		t.Fatal("Expected a TrimmedError, got ", err)
+	}
+	if len(messages) != 100 || trimmed.FirstAvailableId != messages[0].MessageId {
+		t.Errorf("Expected the 100 remaining messages starting at %d, got %d", trimmed.FirstAvailableId, len(messages))
+	}
+
+	resumed := messages[len(messages)-1].Cursor()
+	topic.Push("next")
+	if messages, err := topic.PullSinceCursor(1000, resumed); err != nil || len(messages) != 1 {
+		t.Error("Expected to resume without missing messages, got ", messages, err)
+	}
+}
+
+func TestPullSinceUntil(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	topic := ps.Topic("TestPullSinceUntil")
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		close(done)
+	}()
+	started := time.Now()
+	if messages := topic.PullSinceUntil(done, 60000, 0); len(messages) != 0 || time.Since(started) > time.Second*5 {
+		t.Errorf("Expected the pull to stop when done closed, got %v after %v", messages, time.Since(started))
+	}
+	topic.Push("one")
+	if messages := topic.PullSinceUntil(make(chan struct{}), 1000, 0); len(messages) != 1 {
+		t.Error("Expected the pull to return the message, got ", messages)
+	}
+}
+
+func TestPullSinceZeroCursorTrimmed(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	topic := ps.Topic("TestPullSinceZeroCursorTrimmed")
+	for i := 0; i < 150; i++ {
+		topic.Push(strconv.Itoa(i))
+	}
+
+	messages, err := topic.PullSinceCursor(1000, Cursor{})
+	var trimmed *TrimmedError
+	if !errors.As(err, &trimmed) {
+		t.Fatal("Expected a TrimmedError for the zero cursor, got ", err)
+	}
+	if len(messages) != 100 || trimmed.FirstAvailableId != messages[0].MessageId {
+		t.Errorf("Expected the 100 remaining messages starting at %d, got %d", trimmed.FirstAvailableId, len(messages))
+	}
+}
+
+func TestPullSinceCursorTrimRace(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	topic := ps.Topic("TestPullSinceCursorTrimRace")
+	topic.Push("first")
+	cursor := Cursor{Generation: topic.Stats().Generation, MessageId: topic.LastMessageId()}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			topic.Push(strconv.Itoa(i))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		messages, err := topic.PullSinceCursor(1000, cursor)
+		if len(messages) == 0 && cursor.MessageId == topic.LastMessageId() {
+			// the publisher finished after the check above and every message was pulled
+			<-done
+			return
+		}
+		if len(messages) == 0 {
+			t.Fatal("Expected messages after the cursor, got ", err)
+		}
+		// a gap after the cursor is only allowed when the pull reports it
+		if messages[0].MessageId != cursor.MessageId+1 && !errors.Is(err, ErrCursorTrimmed) {
+			t.Fatalf("Expected a TrimmedError for the gap after %d, got %d and %v", cursor.MessageId, messages[0].MessageId, err)
+		}
+		cursor = messages[len(messages)-1].Cursor()
+	}
+}
+
+func TestHistory(t *testing.T) {
+	t.Parallel()
+
+	ps := NewPubySuby()
+	for i := 1; i <= 10; i++ {
+		ps.Push("TestHistory", strconv.Itoa(i))
+	}
+
+	// page through the older messages backwards like a chat UI
+	var pages []string
+	query := HistoryQuery{To: 8, Limit: 3, Reverse: true}
+	for {
+		page := ps.History("TestHistory", query)
+		var ids []string
+		for _, item := range page.Items {
+			ids = append(ids, item.Message)
+		}
+		pages = append(pages, strings.Join(ids, ","))
+		if page.Next == 0 {
+			break
+		}
+		query.To = page.Next
+	}
+	if strings.Join(pages, "|") != "8,7,6|5,4,3|2,1" {
+		t.Error("Expected the reverse pages 8,7,6|5,4,3|2,1, got ", pages)
+	}
+
+	page := ps.History("TestHistory", HistoryQuery{From: 9})
+	if len(page.Items) != 2 || page.Items[0].Message != "9" || page.Next != 0 {
+		t.Error("Expected messages 9 and 10 and no next page, got ", page)
+	}
+}
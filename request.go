@@ -0,0 +1,178 @@
+package pubysuby
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Headers used by Request and Respond
+const (
+	// ReplyToHeader names the topic the reply is published to
+	ReplyToHeader = "reply-to"
+	// CorrelationIdHeader ties a reply to its request
+	CorrelationIdHeader = "correlation-id"
+	// ErrorHeader carries the error a responder's handler returned
+	ErrorHeader = "error"
+)
+
+// ErrResponderFailed is returned by Request when the responder's handler returned an error
+var ErrResponderFailed = errors.New("pubysuby: responder failed")
+
+// ResponderFunc handles a request and returns the reply message
+type ResponderFunc func(request TopicItem) (string, error)
+
+// Responder answers the requests published to a topic
+type Responder struct {
+	ps           *PubySuby
+	subscription *Subscription
+}
+
+// Respond subscribes the handler to the topic, every message that carries a reply-to header
+// is passed to the handler in its own goroutine and the result is published to the reply-to topic
+func (ps *PubySuby) Respond(topic string, handler ResponderFunc) *Responder {
+	r := &Responder{ps: ps, subscription: ps.Sub(topic)}
+	go func() {
+		for messages := range r.subscription.ListenChannel {
+			for _, request := range messages {
+				if request.Headers[ReplyToHeader] == "" {
+					continue
+				}
+				go r.reply(request, handler)
+			}
+		}
+	}()
+	return r
+}
+
+func (r *Responder) reply(request TopicItem, handler ResponderFunc) {
+	headers := map[string]string{CorrelationIdHeader: request.Headers[CorrelationIdHeader]}
+	message, err := handler(request)
+	if err != nil {
+		headers[ErrorHeader] = err.Error()
+	}
+	r.ps.PushWithHeaders(request.Headers[ReplyToHeader], headers, message)
+}
+
+// Stop unsubscribes the responder from its topic
+func (r *Responder) Stop() {
+	r.ps.Unsubscribe(r.subscription)
+}
+
+// Request publishes the message to the topic and waits for the first reply
+func (ps *PubySuby) Request(ctx context.Context, topic string, message string) (TopicItem, error) {
+	replies, err := ps.RequestMany(ctx, topic, message, 1)
+	if err != nil {
+		return TopicItem{}, err
+	}
+	if reason := replies[0].Headers[ErrorHeader]; reason != "" {
+		return replies[0], &responderError{reason: reason}
+	}
+	return replies[0], nil
+}
+
+// RequestMany publishes the message to the topic and gathers the replies of every responder.
+// With max > 0 it returns as soon as max replies arrived, or the replies so far and ctx.Err() when ctx is done first.
+// With max <= 0 it gathers replies until ctx is done.
+func (ps *PubySuby) RequestMany(ctx context.Context, topic string, message string, max int) ([]TopicItem, error) {
+	inbox := ps.getInbox()
+	correlationId, replyChannel, done := inbox.register()
+	defer inbox.deregister(correlationId, done)
+
+	ps.PushWithHeaders(topic, map[string]string{
+		ReplyToHeader:       inbox.topicName,
+		CorrelationIdHeader: correlationId,
+	}, message)
+
+	var replies []TopicItem
+	for {
+		select {
+		case reply := <-replyChannel:
+			replies = append(replies, reply)
+			if max > 0 && len(replies) >= max {
+				return replies, nil
+			}
+		case <-ctx.Done():
+			if max <= 0 {
+				return replies, nil
+			}
+			return replies, ctx.Err()
+		}
+	}
+}
+
+type responderError struct {
+	reason string
+}
+
+func (e *responderError) Error() string {
+	return ErrResponderFailed.Error() + ": " + e.reason
+}
+
+func (e *responderError) Unwrap() error {
+	return ErrResponderFailed
+}
+
+// inbox is the hub's topic for replies, a single subscription dispatches them by correlation id
+type inbox struct {
+	topicName string
+	lastId    int64 // accessed atomically
+	mu        sync.Mutex
+	waiting   map[string]inboxWaiter
+}
+
+type inboxWaiter struct {
+	replyChannel chan TopicItem
+	done         chan struct{}
+}
+
+func (ps *PubySuby) getInbox() *inbox {
+	ps.inboxOnce.Do(func() {
+		random := make([]byte, 8)
+		rand.Read(random)
+		ps.inbox = &inbox{
+			topicName: "_INBOX." + hex.EncodeToString(random),
+			waiting:   make(map[string]inboxWaiter),
+		}
+		go ps.inbox.dispatch(ps.Sub(ps.inbox.topicName))
+	})
+	return ps.inbox
+}
+
+func (in *inbox) register() (string, chan TopicItem, chan struct{}) {
+	correlationId := strconv.FormatInt(atomic.AddInt64(&in.lastId, 1), 10)
+	waiter := inboxWaiter{replyChannel: make(chan TopicItem), done: make(chan struct{})}
+	in.mu.Lock()
+	in.waiting[correlationId] = waiter
+	in.mu.Unlock()
+	return correlationId, waiter.replyChannel, waiter.done
+}
+
+func (in *inbox) deregister(correlationId string, done chan struct{}) {
+	in.mu.Lock()
+	delete(in.waiting, correlationId)
+	in.mu.Unlock()
+	close(done)
+}
+
+func (in *inbox) dispatch(subscription *Subscription) {
+	for messages := range subscription.ListenChannel {
+		for _, reply := range messages {
+			in.mu.Lock()
+			waiter, ok := in.waiting[reply.Headers[CorrelationIdHeader]]
+			in.mu.Unlock()
+			if !ok {
+				// late reply to a request that already returned
+				continue
+			}
+			select {
+			case waiter.replyChannel <- reply:
+			case <-waiter.done:
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package resp
+
+// matchPattern reports whether the name matches the glob pattern the way Redis matches PSUBSCRIBE patterns:
+// * matches any run of characters, slashes included, ? matches one character,
+// [abc], [^abc] and [a-z] match a character class and \ escapes the next character.
+// After a mismatch only the last * takes one more character and matching resumes behind it,
+// so the time is bounded by the lengths of the pattern and the name multiplied, whatever the number of stars.
+func matchPattern(pattern string, name string) bool {
+	p, n := 0, 0
+	// position of the last * and of the name where it stopped, star is -1 before the first *
+	star, starName := -1, 0
+	for n < len(name) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starName = p, n
+				p++
+				continue
+			}
+			if next, ok := matchOne(pattern, p, name[n]); ok {
+				p, n = next, n+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starName++
+		p, n = star+1, starName
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchOne matches c against the pattern element at p, which is not a *,
+// and returns the position of the next element
+func matchOne(pattern string, p int, c byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		matched, rest, ok := matchClass(pattern[p+1:], c)
+		if !ok {
+			// an unterminated class matches a literal [
+			return p + 1, c == '['
+		}
+		return len(pattern) - len(rest), matched
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return p + 1, pattern[p] == c
+}
+
+// matchClass matches c against the class that starts after the [,
+// it returns the pattern after the ] and false for ok when the class is not terminated
+func matchClass(class string, c byte) (bool, string, bool) {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		switch {
+		case class[i] == ']':
+			return matched != negate, class[i+1:], true
+		case class[i] == '\\' && i+1 < len(class):
+			i++
+			if class[i] == c {
+				matched = true
+			}
+		case i+2 < len(class) && class[i+1] == '-' && class[i+2] != ']':
+			low, high := class[i], class[i+2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				matched = true
+			}
+			i += 2
+		default:
+			if class[i] == c {
+				matched = true
+			}
+		}
+	}
+	return false, "", false
+}
@@ -0,0 +1,165 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// the largest array and line a client may send
+const (
+	maxArrayLength  = 1 << 20
+	maxInlineLength = 64 << 10
+)
+
+// the largest bulk string a client may send unless the Server says otherwise
+const defaultMaxBulkLength = 1 << 20
+
+// how many arguments readCommand makes room for before it reads them,
+// a larger array grows as its arguments arrive
+const argumentsHint = 16
+
+// errProtocol is returned for a request that is not valid RESP
+var errProtocol = errors.New("Protocol error")
+
+// Reply values besides string (bulk string), int64 (integer), nil (null) and []interface{} (array)
+type (
+	simpleString string
+	errorReply   string
+	// nullArray is the reply of an XREAD that timed out
+	nullArray struct{}
+	// pushReply is an out of band message of a subscription, a push in RESP3 and an array in RESP2
+	pushReply []interface{}
+	// mapReply holds keys and values in turn, a map in RESP3 and an array in RESP2
+	mapReply []interface{}
+)
+
+var ok = simpleString("OK")
+
+func errorf(format string, args ...interface{}) errorReply {
+	return errorReply(fmt.Sprintf(format, args...))
+}
+
+// readCommand reads a command, either an array of bulk strings of at most maxBulkLength bytes or an inline command.
+// Only the bytes the client sent are buffered, whatever length it declares.
+func readCommand(r *bufio.Reader, maxBulkLength int) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// inline commands are what telnet sends
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > maxArrayLength {
+		return nil, errProtocol
+	}
+	hint := count
+	if hint > argumentsHint {
+		hint = argumentsHint
+	}
+	args := make([]string, 0, hint)
+	for i := 0; i < count; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, errProtocol
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r, int64(length)+2))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < length+2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if data[length] != '\r' || data[length+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, string(data[:length]))
+	}
+	return args, nil
+}
+
+// readLine reads a line of at most maxInlineLength bytes, a longer one is a protocol error
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLength+2 {
+			return "", errProtocol
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// writeValue encodes the reply in the protocol version 2 or 3, it fails for a value no reply is made of
+func writeValue(w *bufio.Writer, v interface{}, proto int) error {
+	switch v := v.(type) {
+	case nil:
+		if proto == 3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case nullArray:
+		if proto == 3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("*-1\r\n")
+		}
+	case simpleString:
+		w.WriteString("+" + string(v) + "\r\n")
+	case errorReply:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []interface{}:
+		return writeAggregate(w, '*', len(v), v, proto)
+	case pushReply:
+		if proto == 3 {
+			return writeAggregate(w, '>', len(v), v, proto)
+		}
+		return writeAggregate(w, '*', len(v), v, proto)
+	case mapReply:
+		if proto == 3 {
+			return writeAggregate(w, '%', len(v)/2, v, proto)
+		}
+		return writeAggregate(w, '*', len(v), v, proto)
+	default:
+		return fmt.Errorf("resp: cannot encode %T", v)
+	}
+	return nil
+}
+
+func writeAggregate(w *bufio.Writer, kind byte, length int, values []interface{}, proto int) error {
+	w.WriteByte(kind)
+	w.WriteString(strconv.Itoa(length) + "\r\n")
+	for _, value := range values {
+		if err := writeValue(w, value, proto); err != nil {
+			return err
+		}
+	}
+	return nil
+}
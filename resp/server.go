@@ -0,0 +1,436 @@
+// Package resp serves a PubySuby hub over the Redis protocol, RESP2 and RESP3 after HELLO 3,
+// so redis-cli and Redis client libraries can use it.
+//
+// Pub/sub maps directly onto the topics: PUBLISH pushes a message, SUBSCRIBE subscribes to a topic
+// and PSUBSCRIBE to every topic matching a glob pattern, including the topics created later.
+// A topic can also be read as a stream: XADD publishes the field value pairs as a message,
+// the field "message" becoming the message and the others its headers, and XRANGE and XREAD [BLOCK]
+// read the retained messages. Stream ids are the message ids with a sequence of 0, "42-0".
+//
+// Like Redis, a subscriber that lets SendQueue messages pile up is disconnected.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend"
+)
+
+// how many messages may wait to be sent to a subscriber unless the Server says otherwise
+const defaultSendQueue = 4096
+
+// how often PSUBSCRIBE looks for new topics unless the Server says otherwise
+const defaultPatternInterval = time.Second
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server speaks the Redis protocol for a hub
+type Server struct {
+	ps *pubysuby.PubySuby
+	// SendQueue is how many messages may wait to be sent before a subscriber is disconnected
+	SendQueue int
+	// PatternInterval is how often a PSUBSCRIBE looks for new topics that match its pattern
+	PatternInterval time.Duration
+	// MaxBulkLength is the largest bulk string a client may send
+	MaxBulkLength int
+
+	front  frontend.Server
+	mu     sync.Mutex
+	nextId int64
+}
+
+// New creates a Server for the hub
+func New(ps *pubysuby.PubySuby) *Server {
+	return &Server{
+		ps:              ps,
+		SendQueue:       defaultSendQueue,
+		PatternInterval: defaultPatternInterval,
+		MaxBulkLength:   defaultMaxBulkLength,
+	}
+}
+
+// ListenAndServe listens on the TCP address, such as ":6379", and serves the connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until it fails or the Server is closed
+func (s *Server) Serve(l net.Listener) error {
+	return s.front.Serve(l, ErrServerClosed, func(netConn net.Conn) {
+		front := s.front.Add(netConn, s.SendQueue)
+		if front == nil {
+			return
+		}
+		s.mu.Lock()
+		s.nextId++
+		id := s.nextId
+		s.mu.Unlock()
+		c := &conn{
+			server:   s,
+			id:       id,
+			netConn:  netConn,
+			r:        bufio.NewReader(netConn),
+			w:        bufio.NewWriter(netConn),
+			proto:    2,
+			front:    front,
+			channels: make(map[string]*frontend.Subscription),
+			patterns: make(map[string]*patternSubscription),
+		}
+		c.serve()
+	})
+}
+
+// Close stops the listeners and closes every connection
+func (s *Server) Close() error {
+	s.front.Close()
+	return nil
+}
+
+// patternSubscription watches the hub for the topics that match its pattern
+type patternSubscription struct {
+	pattern string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// conn is the state of one connection.
+// The reading goroutine owns the subscriptions and answers the commands,
+// the delivering goroutine sends the messages of the subscriptions.
+type conn struct {
+	server  *Server
+	id      int64
+	netConn net.Conn
+	r       *bufio.Reader
+
+	mu sync.Mutex
+	w  *bufio.Writer
+	// the protocol version, 2 or 3
+	proto int
+
+	// queues the messages of the subscriptions
+	front    *frontend.Conn
+	channels map[string]*frontend.Subscription
+	patterns map[string]*patternSubscription
+}
+
+// serve answers the client's commands until the connection closes, then it ends every subscription
+func (c *conn) serve() {
+	defer func() {
+		c.front.End()
+		for _, sub := range c.channels {
+			sub.Unsubscribe()
+		}
+		for _, p := range c.patterns {
+			close(p.stop)
+		}
+	}()
+	go c.writeDeliveries()
+	for {
+		args, err := readCommand(c.r, c.server.MaxBulkLength)
+		if err == errProtocol {
+			c.reply(errorReply("ERR Protocol error"))
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !c.handle(strings.ToUpper(args[0]), args[1:]) {
+			return
+		}
+	}
+}
+
+// handle runs the command, it returns false when the connection is to be closed
+func (c *conn) handle(command string, args []string) bool {
+	if c.subscribed() && c.protocol() == 2 {
+		switch command {
+		case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING", "QUIT", "RESET":
+		default:
+			c.reply(errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(command)))
+			return true
+		}
+	}
+	switch command {
+	case "PING":
+		c.ping(args)
+	case "ECHO":
+		if len(args) != 1 {
+			c.reply(wrongArity(command))
+		} else {
+			c.reply(args[0])
+		}
+	case "HELLO":
+		c.hello(args)
+	case "QUIT":
+		c.reply(ok)
+		return false
+	case "RESET":
+		c.unsubscribe(nil, false)
+		c.punsubscribe(nil, false)
+		c.setProtocol(2)
+		c.reply(simpleString("RESET"))
+	case "SELECT", "CLIENT":
+		c.reply(ok)
+	case "COMMAND":
+		c.reply([]interface{}{})
+	case "PUBLISH":
+		c.publish(args)
+	case "SUBSCRIBE":
+		c.subscribe(args)
+	case "PSUBSCRIBE":
+		c.psubscribe(args)
+	case "UNSUBSCRIBE":
+		c.unsubscribe(args, true)
+	case "PUNSUBSCRIBE":
+		c.punsubscribe(args, true)
+	case "XADD":
+		c.xadd(args)
+	case "XRANGE":
+		c.xrange(args)
+	case "XREAD":
+		c.xread(args)
+	default:
+		c.reply(errorf("ERR unknown command '%s'", strings.ToLower(command)))
+	}
+	return true
+}
+
+func (c *conn) ping(args []string) {
+	if len(args) > 1 {
+		c.reply(wrongArity("PING"))
+		return
+	}
+	if c.subscribed() && c.protocol() == 2 {
+		message := ""
+		if len(args) == 1 {
+			message = args[0]
+		}
+		c.reply(pushReply{"pong", message})
+	} else if len(args) == 1 {
+		c.reply(args[0])
+	} else {
+		c.reply(simpleString("PONG"))
+	}
+}
+
+func (c *conn) hello(args []string) {
+	proto := c.protocol()
+	if len(args) > 0 {
+		switch args[0] {
+		case "2":
+			proto = 2
+		case "3":
+			proto = 3
+		default:
+			c.reply(errorReply("NOPROTO unsupported protocol version"))
+			return
+		}
+	}
+	c.setProtocol(proto)
+	c.reply(mapReply{
+		"server", "pubysuby",
+		"proto", int64(proto),
+		"id", c.id,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []interface{}{},
+	})
+}
+
+func (c *conn) publish(args []string) {
+	if len(args) != 2 {
+		c.reply(wrongArity("PUBLISH"))
+		return
+	}
+	topic := c.server.ps.Topic(args[0])
+	topic.Push(args[1])
+	c.reply(int64(topic.Stats().Subscribers))
+}
+
+func (c *conn) subscribe(channels []string) {
+	if len(channels) == 0 {
+		c.reply(wrongArity("SUBSCRIBE"))
+		return
+	}
+	for _, channel := range channels {
+		if _, ok := c.channels[channel]; !ok {
+			sub := frontend.Subscribe(c.server.ps.Topic(channel))
+			c.channels[channel] = sub
+			// answer before the first delivery
+			defer func() { go c.forward(sub, "", time.Time{}) }()
+		}
+		c.reply(pushReply{"subscribe", channel, c.subscriptionCount()})
+	}
+}
+
+func (c *conn) psubscribe(patterns []string) {
+	if len(patterns) == 0 {
+		c.reply(wrongArity("PSUBSCRIBE"))
+		return
+	}
+	for _, pattern := range patterns {
+		if _, ok := c.patterns[pattern]; !ok {
+			p := &patternSubscription{pattern: pattern, stop: make(chan struct{}), done: make(chan struct{})}
+			c.patterns[pattern] = p
+			since := time.Now()
+			defer func() { go c.watchPattern(p, since) }()
+		}
+		c.reply(pushReply{"psubscribe", pattern, c.subscriptionCount()})
+	}
+}
+
+// unsubscribe ends the subscriptions to the channels, or every one when there are none,
+// answering for each when reply is set
+func (c *conn) unsubscribe(channels []string, reply bool) {
+	if len(channels) == 0 {
+		for channel := range c.channels {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+		if len(channels) == 0 && reply {
+			c.reply(pushReply{"unsubscribe", nil, c.subscriptionCount()})
+		}
+	}
+	for _, channel := range channels {
+		if sub, ok := c.channels[channel]; ok {
+			delete(c.channels, channel)
+			sub.Unsubscribe()
+		}
+		if reply {
+			c.reply(pushReply{"unsubscribe", channel, c.subscriptionCount()})
+		}
+	}
+}
+
+// punsubscribe ends the subscriptions to the patterns, or every one when there are none,
+// answering for each when reply is set
+func (c *conn) punsubscribe(patterns []string, reply bool) {
+	if len(patterns) == 0 {
+		for pattern := range c.patterns {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		if len(patterns) == 0 && reply {
+			c.reply(pushReply{"punsubscribe", nil, c.subscriptionCount()})
+		}
+	}
+	for _, pattern := range patterns {
+		if p, ok := c.patterns[pattern]; ok {
+			delete(c.patterns, pattern)
+			close(p.stop)
+			<-p.done
+		}
+		if reply {
+			c.reply(pushReply{"punsubscribe", pattern, c.subscriptionCount()})
+		}
+	}
+}
+
+// watchPattern subscribes to the topics that match the pattern as they appear,
+// replaying the messages a new topic received since the PSUBSCRIBE
+func (c *conn) watchPattern(p *patternSubscription, since time.Time) {
+	defer close(p.done)
+	subscriptions := make(map[string]*frontend.Subscription)
+	defer func() {
+		for _, sub := range subscriptions {
+			sub.Unsubscribe()
+		}
+	}()
+	ticker := time.NewTicker(c.server.PatternInterval)
+	defer ticker.Stop()
+	for {
+		for _, topic := range c.server.ps.Topics() {
+			name := topic.Name()
+			if _, ok := subscriptions[name]; ok || !matchPattern(p.pattern, name) {
+				continue
+			}
+			sub := frontend.Subscribe(topic)
+			subscriptions[name] = sub
+			go c.forward(sub, p.pattern, since)
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// forward queues the subscription's messages, first the retained messages created since the time when it is set
+func (c *conn) forward(sub *frontend.Subscription, pattern string, since time.Time) {
+	var replay frontend.Replay
+	if !since.IsZero() {
+		replay.Match = func(item pubysuby.TopicItem) bool {
+			return !item.CreatedTime.Before(since)
+		}
+	}
+	sub.Forward(replay, func(item pubysuby.TopicItem) {
+		message := pushReply{"message", sub.Topic.Name(), item.Message}
+		if pattern != "" {
+			message = pushReply{"pmessage", pattern, sub.Topic.Name(), item.Message}
+		}
+		c.front.Deliver(message)
+	})
+}
+
+func (c *conn) writeDeliveries() {
+	for {
+		select {
+		case <-c.front.Done():
+			return
+		case message := <-c.front.Deliveries:
+			c.reply(message)
+		}
+	}
+}
+
+func (c *conn) subscribed() bool {
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+func (c *conn) subscriptionCount() int64 {
+	return int64(len(c.channels) + len(c.patterns))
+}
+
+func (c *conn) protocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proto
+}
+
+func (c *conn) setProtocol(proto int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proto = proto
+}
+
+func (c *conn) reply(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a reply that cannot be encoded leaves the stream out of step, so the connection is closed
+	if err := writeValue(c.w, v, c.proto); err != nil {
+		c.netConn.Close()
+		return
+	}
+	if err := c.w.Flush(); err != nil {
+		c.netConn.Close()
+	}
+}
+
+func wrongArity(command string) errorReply {
+	return errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+}
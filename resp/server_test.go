@@ -0,0 +1,277 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend/frontendtest"
+)
+
+type testClient struct {
+	*frontendtest.Conn
+}
+
+// start serves the server and connects a client to it
+func start(t *testing.T, server *Server) *testClient {
+	return dial(t, frontendtest.Listen(t, server))
+}
+
+func dial(t *testing.T, l net.Listener) *testClient {
+	return &testClient{frontendtest.Dial(t, l)}
+}
+
+// do sends the command and reads the reply
+func (c *testClient) do(args ...string) interface{} {
+	c.send(args...)
+	return c.receive()
+}
+
+func (c *testClient) send(args ...string) {
+	command := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		command += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := c.Write([]byte(command)); err != nil {
+		c.T.Fatal(err)
+	}
+}
+
+// receive reads a reply, errors as error, nulls as nil and aggregates as []interface{} prefixed by their kind
+func (c *testClient) receive() interface{} {
+	v, err := readReply(c.Reader())
+	if err != nil {
+		c.T.Fatal(err)
+	}
+	return v
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return fmt.Errorf("%s", line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '_':
+		return nil, nil
+	case '$':
+		length, _ := strconv.Atoi(line[1:])
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*', '>', '%':
+		length, _ := strconv.Atoi(line[1:])
+		if length < 0 {
+			return nil, nil
+		}
+		if line[0] == '%' {
+			length *= 2
+		}
+		values := []interface{}{string(line[0])}
+		for i := 0; i < length; i++ {
+			v, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown reply %q", line)
+}
+
+func TestPubSub(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.PatternInterval = time.Millisecond * 10
+	l := frontendtest.Listen(t, server)
+	subscriber := dial(t, l)
+
+	frontendtest.Expect(t, subscriber.do("PING"), "PONG")
+	frontendtest.Expect(t, subscriber.do("SUBSCRIBE", "news", "chat"), []interface{}{"*", "subscribe", "news", int64(1)})
+	frontendtest.Expect(t, subscriber.receive(), []interface{}{"*", "subscribe", "chat", int64(2)})
+	frontendtest.Expect(t, subscriber.do("PSUBSCRIBE", "sensors/*"), []interface{}{"*", "psubscribe", "sensors/*", int64(3)})
+	if err, ok := subscriber.do("XADD", "news", "*", "message", "hi").(error); !ok || !strings.Contains(err.Error(), "only (P)SUBSCRIBE") {
+		t.Errorf("Expected other commands to be refused while subscribed, got %v", err)
+	}
+	frontendtest.Expect(t, subscriber.do("PING", "hello"), []interface{}{"*", "pong", "hello"})
+
+	// the publishing connection of a test client must not be the subscribing one
+	pub := dial(t, l)
+	frontendtest.Expect(t, pub.do("PUBLISH", "news", "extra"), int64(1))
+	frontendtest.Expect(t, subscriber.receive(), []interface{}{"*", "message", "news", "extra"})
+
+	// a topic created after the PSUBSCRIBE is found, and its first message is not lost
+	pub.do("PUBLISH", "sensors/kitchen/temperature", "21")
+	frontendtest.Expect(t, subscriber.receive(), []interface{}{"*", "pmessage", "sensors/*", "sensors/kitchen/temperature", "21"})
+
+	frontendtest.Expect(t, subscriber.do("UNSUBSCRIBE", "news"), []interface{}{"*", "unsubscribe", "news", int64(2)})
+	frontendtest.Expect(t, subscriber.do("PUNSUBSCRIBE"), []interface{}{"*", "punsubscribe", "sensors/*", int64(1)})
+	frontendtest.Expect(t, subscriber.do("UNSUBSCRIBE"), []interface{}{"*", "unsubscribe", "chat", int64(0)})
+	frontendtest.Expect(t, subscriber.do("ECHO", "back to normal"), "back to normal")
+	for _, topic := range []string{"news", "chat", "sensors/kitchen/temperature"} {
+		if subscribers := ps.Stats(topic).Subscribers; subscribers != 0 {
+			t.Errorf("Expected no subscribers on %s, got %d", topic, subscribers)
+		}
+	}
+}
+
+func TestResp3(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	client := start(t, New(ps))
+
+	hello, ok := client.do("HELLO", "3").([]interface{})
+	if !ok || hello[0] != "%" || hello[1] != "server" || hello[2] != "pubysuby" {
+		t.Fatalf("Expected a map from HELLO 3, got %#v", hello)
+	}
+	frontendtest.Expect(t, client.do("SUBSCRIBE", "news"), []interface{}{">", "subscribe", "news", int64(1)})
+	// RESP3 allows every command while subscribed, the push may come before or after the reply
+	first, second := client.do("PUBLISH", "news", "hi"), client.receive()
+	if _, ok := first.(int64); !ok {
+		first, second = second, first
+	}
+	frontendtest.Expect(t, first, int64(1))
+	frontendtest.Expect(t, second, []interface{}{">", "message", "news", "hi"})
+	frontendtest.Expect(t, client.do("XREAD", "STREAMS", "empty", "0"), nil)
+}
+
+func TestStreams(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	client := start(t, New(ps))
+
+	frontendtest.Expect(t, client.do("XADD", "orders", "*", "message", "first", "region", "eu"), "1-0")
+	ps.Push("orders", "second")
+	frontendtest.Expect(t, client.do("XADD", "orders", "*", "sku", "42"), "3-0")
+	if _, ok := client.do("XADD", "orders", "5-0", "message", "x").(error); !ok {
+		t.Errorf("Expected explicit ids to be refused")
+	}
+
+	frontendtest.Expect(t, client.do("XRANGE", "orders", "-", "+"), []interface{}{"*",
+		[]interface{}{"*", "1-0", []interface{}{"*", "region", "eu", "message", "first"}},
+		[]interface{}{"*", "2-0", []interface{}{"*", "message", "second"}},
+		[]interface{}{"*", "3-0", []interface{}{"*", "sku", "42"}},
+	})
+	frontendtest.Expect(t, client.do("XRANGE", "orders", "(1-0", "+", "COUNT", "1"), []interface{}{"*",
+		[]interface{}{"*", "2-0", []interface{}{"*", "message", "second"}},
+	})
+
+	frontendtest.Expect(t, client.do("XREAD", "COUNT", "1", "STREAMS", "orders", "2-0"), []interface{}{"*",
+		[]interface{}{"*", "orders", []interface{}{"*",
+			[]interface{}{"*", "3-0", []interface{}{"*", "sku", "42"}},
+		}},
+	})
+	frontendtest.Expect(t, client.do("XREAD", "BLOCK", "10", "STREAMS", "orders", "$"), nil)
+
+	client.send("XREAD", "BLOCK", "0", "STREAMS", "orders", "$")
+	// wait until the XREAD blocks
+	frontendtest.WaitForSubscribers(t, ps, "orders", 1)
+	ps.Push("orders", "fourth")
+	frontendtest.Expect(t, client.receive(), []interface{}{"*",
+		[]interface{}{"*", "orders", []interface{}{"*",
+			[]interface{}{"*", "4-0", []interface{}{"*", "message", "fourth"}},
+		}},
+	})
+	if subscribers := ps.Stats("orders").Subscribers; subscribers != 0 {
+		t.Errorf("Expected the XREAD to unsubscribe, got %d subscribers", subscribers)
+	}
+}
+
+func TestXreadBlockDisconnect(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	client := start(t, New(ps))
+
+	// a command pipelined behind a blocking XREAD waits for it
+	client.send("XREAD", "BLOCK", "0", "STREAMS", "orders", "$")
+	client.send("PING")
+	frontendtest.WaitForSubscribers(t, ps, "orders", 1)
+	ps.Push("orders", "first")
+	if reply, ok := client.receive().([]interface{}); !ok || len(reply) != 2 {
+		t.Fatalf("Expected the XREAD to return the message, got %v", reply)
+	}
+	frontendtest.Expect(t, client.receive(), "PONG")
+
+	client.send("XREAD", "BLOCK", "0", "STREAMS", "orders", "$")
+	frontendtest.WaitForSubscribers(t, ps, "orders", 1)
+	client.Close()
+	frontendtest.WaitForSubscribers(t, ps, "orders", 0)
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	t.Parallel()
+	for _, request := range []string{"*-5\r\n", "*-1\r\n", strings.Repeat("a", maxInlineLength+1) + "\r\n", "*1\r\n$11\r\n"} {
+		if _, err := readCommand(bufio.NewReader(strings.NewReader(request)), 10); err != errProtocol {
+			t.Errorf("Expected a protocol error for %.10q, got %v", request, err)
+		}
+	}
+	if args, err := readCommand(bufio.NewReader(strings.NewReader("PING hello\r\n")), 10); err != nil || len(args) != 2 {
+		t.Errorf("Expected an inline command, got %v %v", args, err)
+	}
+	// a declared length is not trusted before the bytes arrive
+	if _, err := readCommand(bufio.NewReader(strings.NewReader("*1\r\n$1000000\r\nshort")), defaultMaxBulkLength); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected a bulk string cut short to fail, got %v", err)
+	}
+	if err := writeValue(bufio.NewWriter(ioutil.Discard), []interface{}{"ok", 1.5}, 2); err == nil {
+		t.Error("Expected a reply with a float to fail to encode")
+	}
+
+	client := start(t, New(pubysuby.NewPubySuby()))
+	client.Write([]byte("*-5\r\n"))
+	if err, ok := client.receive().(error); !ok || !strings.Contains(err.Error(), "Protocol error") {
+		t.Errorf("Expected a protocol error reply for a negative array length, got %v", err)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"news.*", "news.sport", true},
+		{"news.*", "news.sport/football", true},
+		{"news.*", "weather", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`news\*`, "news*", true},
+		{`news\*`, "newsx", false},
+		{"*", "", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"**x", "abx", true},
+		{"[ab", "[ab", true},
+		{"*[ab", "x[ab", true},
+		// a star takes one more character only after the pattern behind it failed, so this fails fast
+		{"*a*a*a*a*a*a*a*b", strings.Repeat("a", 1000), false},
+	}
+	for _, c := range cases {
+		if got := matchPattern(c.pattern, c.name); got != c.match {
+			t.Errorf("matchPattern(%q, %q) = %v, expected %v", c.pattern, c.name, got, c.match)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package resp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend"
+)
+
+// the field of a stream entry that holds the message, the other fields are its headers
+const messageField = "message"
+
+func (c *conn) xadd(args []string) {
+	if len(args) < 4 || len(args)%2 != 0 {
+		c.reply(wrongArity("XADD"))
+		return
+	}
+	if args[1] != "*" {
+		c.reply(errorReply("ERR the ids are assigned by pubysuby, only * is supported"))
+		return
+	}
+	var message string
+	headers := make(map[string]string)
+	for i := 2; i < len(args); i += 2 {
+		if args[i] == messageField {
+			message = args[i+1]
+		} else {
+			headers[args[i]] = args[i+1]
+		}
+	}
+	id, err := c.server.ps.Topic(args[0]).PushWithOptions(message, pubysuby.PushOptions{Headers: headers})
+	if err != nil {
+		c.reply(errorf("ERR %v", err))
+		return
+	}
+	c.reply(formatId(id))
+}
+
+// XRANGE key start end [COUNT count]
+func (c *conn) xrange(args []string) {
+	if len(args) != 3 && len(args) != 5 {
+		c.reply(wrongArity("XRANGE"))
+		return
+	}
+	count := 0
+	if len(args) == 5 {
+		if !strings.EqualFold(args[3], "COUNT") {
+			c.reply(errorReply("ERR syntax error"))
+			return
+		}
+		n, err := strconv.Atoi(args[4])
+		if err != nil {
+			c.reply(errorReply("ERR value is not an integer or out of range"))
+			return
+		}
+		if n <= 0 {
+			c.reply([]interface{}{})
+			return
+		}
+		count = n
+	}
+	from, err := parseStart(args[1])
+	if err != nil {
+		c.reply(errorReply("ERR Invalid stream ID specified as stream command argument"))
+		return
+	}
+	to, err := parseEnd(args[2])
+	if err != nil {
+		c.reply(errorReply("ERR Invalid stream ID specified as stream command argument"))
+		return
+	}
+	if to < 0 || (to > 0 && from > to) {
+		c.reply([]interface{}{})
+		return
+	}
+	c.reply(entries(readRange(c.server.ps.Topic(args[0]), from, to, count)))
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func (c *conn) xread(args []string) {
+	count := 0
+	block := time.Duration(-1)
+	i := 0
+	for ; i < len(args) && !strings.EqualFold(args[i], "STREAMS"); i += 2 {
+		if i+1 >= len(args) {
+			c.reply(errorReply("ERR syntax error"))
+			return
+		}
+		n, err := strconv.Atoi(args[i+1])
+		if err != nil || n < 0 {
+			c.reply(errorReply("ERR value is not an integer or out of range"))
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			count = n
+		case "BLOCK":
+			block = time.Duration(n) * time.Millisecond
+		default:
+			c.reply(errorReply("ERR syntax error"))
+			return
+		}
+	}
+	var streams []string
+	if i < len(args) {
+		streams = args[i+1:]
+	}
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		c.reply(errorReply("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."))
+		return
+	}
+	keys, ids := streams[:len(streams)/2], streams[len(streams)/2:]
+	topics := make([]*pubysuby.TopicHandle, len(keys))
+	since := make([]int64, len(keys))
+	for j, key := range keys {
+		topics[j] = c.server.ps.Topic(key)
+		if ids[j] == "$" {
+			since[j] = topics[j].LastMessageId()
+			continue
+		}
+		id, _, err := parseId(ids[j])
+		if err != nil {
+			c.reply(errorReply("ERR Invalid stream ID specified as stream command argument"))
+			return
+		}
+		since[j] = id
+	}
+
+	read := func() []interface{} {
+		var result []interface{}
+		for j, topic := range topics {
+			if items := readRange(topic, since[j]+1, 0, count); len(items) > 0 {
+				result = append(result, []interface{}{keys[j], entries(items)})
+			}
+		}
+		return result
+	}
+	result := read()
+	if len(result) == 0 && block >= 0 {
+		result = c.block(topics, block, read)
+	}
+	if len(result) == 0 {
+		c.reply(nullArray{})
+	} else if c.protocol() == 3 {
+		// RESP3 answers with a map of the keys to their entries
+		var m mapReply
+		for _, stream := range result {
+			m = append(m, stream.([]interface{})...)
+		}
+		c.reply(m)
+	} else {
+		c.reply(result)
+	}
+}
+
+// block waits for read to find entries until a message is published to one of the topics,
+// for the timeout, 0 waits until the connection closes
+func (c *conn) block(topics []*pubysuby.TopicHandle, timeout time.Duration, read func() []interface{}) []interface{} {
+	published := make(chan struct{}, 1)
+	for _, topic := range topics {
+		sub := frontend.Subscribe(topic)
+		defer sub.Unsubscribe()
+		go sub.Forward(frontend.Replay{}, func(pubysuby.TopicItem) {
+			select {
+			case published <- struct{}{}:
+			default:
+			}
+		})
+	}
+	// nothing reads the connection while the command blocks, so watch it for the client going away
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		if _, err := c.r.Peek(1); err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				c.front.Close()
+			}
+		}
+	}()
+	defer func() {
+		// stop the watch before the connection is read again, a pipelined command stays buffered
+		c.netConn.SetReadDeadline(time.Now())
+		<-watched
+		c.netConn.SetReadDeadline(time.Time{})
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		// read again, messages may have been published before the subscriptions started
+		if result := read(); len(result) > 0 {
+			return result
+		}
+		select {
+		case <-published:
+		case <-expired:
+			return nil
+		case <-c.front.Done():
+			return nil
+		}
+	}
+}
+
+// readRange returns the retained messages with ids from from to to, both inclusive and 0 unbounded,
+// at most count of them unless count is 0
+func readRange(topic *pubysuby.TopicHandle, from int64, to int64, count int) []pubysuby.TopicItem {
+	var items []pubysuby.TopicItem
+	query := pubysuby.HistoryQuery{From: from, To: to, Limit: count}
+	for {
+		page := topic.History(query)
+		items = append(items, page.Items...)
+		if page.Next == 0 || (count > 0 && len(items) >= count) {
+			break
+		}
+		query.From = page.Next
+		query.Limit = count - len(items)
+	}
+	return items
+}
+
+// entries converts the messages to stream entries, an id and the field value pairs each
+func entries(items []pubysuby.TopicItem) []interface{} {
+	result := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		keys := make([]string, 0, len(item.Headers))
+		for key := range item.Headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fields := make([]interface{}, 0, 2*len(keys)+2)
+		for _, key := range keys {
+			fields = append(fields, key, item.Headers[key])
+		}
+		if item.Message != "" || len(keys) == 0 {
+			fields = append(fields, messageField, item.Message)
+		}
+		result = append(result, []interface{}{formatId(item.MessageId), fields})
+	}
+	return result
+}
+
+func formatId(id int64) string {
+	return strconv.FormatInt(id, 10) + "-0"
+}
+
+// parseId parses a stream id, "42-0" or "42"
+func parseId(s string) (int64, int64, error) {
+	ms, seq := s, "0"
+	if dash := strings.IndexByte(s, '-'); dash >= 0 {
+		ms, seq = s[:dash], s[dash+1:]
+	}
+	id, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || id < 0 {
+		return 0, 0, fmt.Errorf("bad stream id %q", s)
+	}
+	sequence, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil || sequence < 0 {
+		return 0, 0, fmt.Errorf("bad stream id %q", s)
+	}
+	return id, sequence, nil
+}
+
+// parseStart turns the start of an XRANGE into an inclusive message id, 0 for "-"
+func parseStart(s string) (int64, error) {
+	if s == "-" {
+		return 0, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	id, seq, err := parseId(strings.TrimPrefix(s, "("))
+	if err != nil {
+		return 0, err
+	}
+	// every message id has sequence 0, so any later position starts at the next message
+	if exclusive || seq > 0 {
+		id++
+	}
+	return id, nil
+}
+
+// parseEnd turns the end of an XRANGE into an inclusive message id, 0 for "+" and -1 when nothing is in range
+func parseEnd(s string) (int64, error) {
+	if s == "+" {
+		return 0, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	id, seq, err := parseId(strings.TrimPrefix(s, "("))
+	if err != nil {
+		return 0, err
+	}
+	if exclusive && seq == 0 {
+		id--
+	}
+	if id <= 0 {
+		return -1, nil
+	}
+	return id, nil
+}
@@ -0,0 +1,383 @@
+package pubysuby
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ScheduledMessage is a message held by the hub until its delivery time,
+// it gets a MessageId only when it is published to the topic
+type ScheduledMessage struct {
+	Id      int64
+	Topic   string
+	Message string
+	At      time.Time
+}
+
+// ScheduleStore persists the scheduled messages so they survive a restart of the hub
+type ScheduleStore interface {
+	Save(message ScheduledMessage) error
+	Delete(message ScheduledMessage) error
+	Load() ([]ScheduledMessage, error)
+}
+
+// ScheduleIdStore is a ScheduleStore that also remembers the highest id it saved after the message is deleted,
+// so a restarted hub does not hand out the ids of delivered or cancelled messages again.
+// With a plain ScheduleStore the ids continue after the highest id still stored.
+type ScheduleIdStore interface {
+	ScheduleStore
+	LastId() (int64, error)
+}
+
+// scheduleRequest asks the schedule controller to hold the message, the reply is its id
+type scheduleRequest struct {
+	message ScheduledMessage
+	reply   chan int64
+}
+
+// cancelRequest asks the schedule controller to drop the scheduled message with the id
+type cancelRequest struct {
+	id    int64
+	reply chan bool
+}
+
+// PushAt publishes the message to the topic at the given time,
+// the returned id identifies the scheduled message to Cancel
+func (ps *PubySuby) PushAt(topic string, message string, at time.Time) int64 {
+	reply := make(chan int64, 1)
+	ps.schedule <- scheduleRequest{message: ScheduledMessage{Topic: topic, Message: message, At: at}, reply: reply}
+	return <-reply
+}
+
+// PushAfter publishes the message to the topic once the delay has passed
+func (ps *PubySuby) PushAfter(topic string, message string, delay time.Duration) int64 {
+	return ps.PushAt(topic, message, time.Now().Add(delay))
+}
+
+// Cancel drops a message scheduled with PushAt or PushAfter,
+// it returns false when the message was published already or the id is unknown
+func (ps *PubySuby) Cancel(id int64) bool {
+	reply := make(chan bool, 1)
+	ps.cancelSchedule <- cancelRequest{id: id, reply: reply}
+	return <-reply
+}
+
+// scheduleQueue is a min heap of scheduled messages ordered by delivery time
+type scheduleQueue []ScheduledMessage
+
+func (q scheduleQueue) Len() int { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool {
+	if q[i].At.Equal(q[j].At) {
+		return q[i].Id < q[j].Id
+	}
+	return q[i].At.Before(q[j].At)
+}
+func (q scheduleQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *scheduleQueue) Push(x interface{}) { *q = append(*q, x.(ScheduledMessage)) }
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	message := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return message
+}
+
+// scheduleController holds the scheduled messages and hands them to a delivering goroutine when they are due,
+// a single timer is armed for the earliest one.
+// Every topic has at most one delivering goroutine, so a blocked topic holds up only its own messages
+// and the messages of a topic are published in order.
+func (ps *PubySuby) scheduleController() {
+	var queue scheduleQueue
+	var lastId int64
+	store := ps.options.ScheduleStore
+	if store != nil {
+		stored, err := store.Load()
+		if err != nil {
+			log.Println("Failed to load scheduled messages:", err)
+		}
+		for _, message := range stored {
+			if message.Id > lastId {
+				lastId = message.Id
+			}
+			heap.Push(&queue, message)
+		}
+		if idStore, ok := store.(ScheduleIdStore); ok {
+			stored, err := idStore.LastId()
+			if err != nil {
+				log.Println("Failed to load the last scheduled message id:", err)
+			}
+			if stored > lastId {
+				lastId = stored
+			}
+		}
+	}
+	// key: topic with a delivering goroutine
+	// value: the due messages waiting for it
+	backlog := make(map[string][]ScheduledMessage)
+	delivered := make(chan string)
+
+	timer := time.NewTimer(time.Hour)
+	for {
+		// re-arm the timer for the earliest message
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var due <-chan time.Time
+		if queue.Len() > 0 {
+			timer.Reset(time.Until(queue[0].At))
+			due = timer.C
+		}
+
+		select {
+		case request := <-ps.schedule:
+			lastId++
+			message := request.message
+			message.Id = lastId
+			if store != nil {
+				if err := store.Save(message); err != nil {
+					log.Println("Failed to persist scheduled message:", err)
+				}
+			}
+			heap.Push(&queue, message)
+			request.reply <- message.Id
+		case request := <-ps.cancelSchedule:
+			cancelled, found := ScheduledMessage{}, false
+			for i, message := range queue {
+				if message.Id == request.id {
+					cancelled, found = heap.Remove(&queue, i).(ScheduledMessage), true
+					break
+				}
+			}
+			for topic, messages := range backlog {
+				for i, message := range messages {
+					if message.Id == request.id {
+						cancelled, found = message, true
+						backlog[topic] = append(messages[:i:i], messages[i+1:]...)
+						break
+					}
+				}
+			}
+			if found && store != nil {
+				if err := store.Delete(cancelled); err != nil {
+					log.Println("Failed to delete cancelled scheduled message:", err)
+				}
+			}
+			request.reply <- found
+		case now := <-due:
+			for queue.Len() > 0 && !queue[0].At.After(now) {
+				message := heap.Pop(&queue).(ScheduledMessage)
+				if messages, delivering := backlog[message.Topic]; delivering {
+					backlog[message.Topic] = append(messages, message)
+				} else {
+					backlog[message.Topic] = nil
+					go ps.deliverScheduled(message, delivered)
+				}
+			}
+		case topic := <-delivered:
+			if messages := backlog[topic]; len(messages) > 0 {
+				backlog[topic] = messages[1:]
+				go ps.deliverScheduled(messages[0], delivered)
+			} else {
+				delete(backlog, topic)
+			}
+		}
+	}
+}
+
+// deliverScheduled publishes the due message, then reports its topic as done
+func (ps *PubySuby) deliverScheduled(message ScheduledMessage, delivered chan<- string) {
+	ps.Push(message.Topic, message.Message)
+	if store := ps.options.ScheduleStore; store != nil {
+		if err := store.Delete(message); err != nil {
+			log.Println("Failed to delete delivered scheduled message:", err)
+		}
+	}
+	delivered <- message.Topic
+}
+
+// the FileScheduleStore is compacted once its log holds compactRatio times as many lines as there are messages,
+// and at least minCompactLines lines
+const (
+	compactRatio    = 4
+	minCompactLines = 64
+)
+
+// FileScheduleStore keeps the scheduled messages in a log of JSON lines,
+// every change is appended and the log is compacted once most of its lines are stale.
+// It is a ScheduleIdStore, the compacted log starts with the highest id saved.
+type FileScheduleStore struct {
+	path   string
+	mu     sync.Mutex
+	loaded bool
+	file   *os.File
+	lines  int
+	// the log ends with a torn line, the next change compacts it instead of appending after it
+	torn     bool
+	messages map[int64]ScheduledMessage
+	// highest id saved, including the messages deleted since
+	lastId int64
+}
+
+// scheduleRecord is a line of the log
+type scheduleRecord struct {
+	Delete bool `json:",omitempty"`
+	// LastId records the highest id saved, the compacted log starts with it
+	LastId  int64 `json:",omitempty"`
+	Message ScheduledMessage
+}
+
+func NewFileScheduleStore(path string) *FileScheduleStore {
+	return &FileScheduleStore{path: path, messages: make(map[int64]ScheduledMessage)}
+}
+
+func (fs *FileScheduleStore) Load() ([]ScheduledMessage, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	messages := make([]ScheduledMessage, 0, len(fs.messages))
+	for _, message := range fs.messages {
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (fs *FileScheduleStore) LastId() (int64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.load(); err != nil {
+		return 0, err
+	}
+	return fs.lastId, nil
+}
+
+// load replays the log, a torn last line left by a crash is ignored
+func (fs *FileScheduleStore) load() error {
+	if fs.loaded {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fs.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lines := bytes.Split(data, []byte{'\n'})
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var record scheduleRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-1 {
+				fs.torn = true
+				break
+			}
+			return err
+		}
+		fs.lines++
+		if record.LastId > fs.lastId {
+			fs.lastId = record.LastId
+		}
+		if record.Message.Id > fs.lastId {
+			fs.lastId = record.Message.Id
+		}
+		if record.LastId != 0 {
+			continue
+		}
+		if record.Delete {
+			delete(fs.messages, record.Message.Id)
+		} else {
+			fs.messages[record.Message.Id] = record.Message
+		}
+	}
+	fs.loaded = true
+	return nil
+}
+
+func (fs *FileScheduleStore) Save(message ScheduledMessage) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.load(); err != nil {
+		return err
+	}
+	fs.messages[message.Id] = message
+	if message.Id > fs.lastId {
+		fs.lastId = message.Id
+	}
+	return fs.append(scheduleRecord{Message: message})
+}
+
+func (fs *FileScheduleStore) Delete(message ScheduledMessage) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.load(); err != nil {
+		return err
+	}
+	delete(fs.messages, message.Id)
+	return fs.append(scheduleRecord{Delete: true, Message: ScheduledMessage{Id: message.Id}})
+}
+
+func (fs *FileScheduleStore) append(record scheduleRecord) error {
+	if fs.torn || fs.lines >= minCompactLines && fs.lines >= compactRatio*len(fs.messages) {
+		return fs.compact()
+	}
+	if fs.file == nil {
+		file, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		fs.file = file
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	fs.lines++
+	return nil
+}
+
+// compact replaces the log with the last id and a line per message through a rename,
+// so a crash never leaves it half written
+func (fs *FileScheduleStore) compact() error {
+	var data []byte
+	lines := len(fs.messages)
+	if fs.lastId != 0 {
+		line, err := json.Marshal(scheduleRecord{LastId: fs.lastId})
+		if err != nil {
+			return err
+		}
+		data = append(line, '\n')
+		lines++
+	}
+	for _, message := range fs.messages {
+		line, err := json.Marshal(scheduleRecord{Message: message})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := ioutil.WriteFile(fs.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(fs.path+".tmp", fs.path); err != nil {
+		return err
+	}
+	if fs.file != nil {
+		fs.file.Close()
+		fs.file = nil
+	}
+	fs.lines = lines
+	fs.torn = false
+	return nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Op is the operation of a frame
+type Op byte
+
+// Requests sent by the client
+const (
+	// PUB topic, message; answered by OK with the message id
+	OpPub Op = 1
+	// SUB topic; answered by OK, then every message is delivered as MSG with the SUB's frame id
+	OpSub Op = 2
+	// UNSUB topic; answered by OK
+	OpUnsub Op = 3
+	// PULL topic, timeout in milliseconds; answered by ITEMS
+	OpPull Op = 4
+	// PULLSINCE topic, since message id, timeout in milliseconds; answered by ITEMS
+	OpPullSince Op = 5
+	// LASTID topic; answered by OK with the last message id
+	OpLastId Op = 6
+	// ACK count; acknowledges that many MSG frames, it is not answered
+	OpAck Op = 7
+	// PING; answered by PONG
+	OpPing Op = 8
+)
+
+// Replies sent by the server
+const (
+	// OK, with a message id for PUB and LASTID
+	OpOk Op = 0x81
+	// ERR message
+	OpErr Op = 0x82
+	// ITEMS count, then id, created time in unix nanoseconds and message for every item
+	OpItems Op = 0x83
+	// MSG topic, id, created time in unix nanoseconds, message
+	OpMsg Op = 0x84
+	// PONG
+	OpPong Op = 0x85
+)
+
+// how large a frame ReadFrame accepts unless the Server says otherwise
+const DefaultMaxFrameSize = 16 << 20
+
+// the op and id that follow the length of every frame
+const frameHeaderLength = 5
+
+// ErrFrameTooLarge is returned by ReadFrame for a frame over the size limit
+var ErrFrameTooLarge = errors.New("server: frame too large")
+
+// Frame is the unit of the wire protocol:
+// a big endian uint32 length of the rest of the frame, the op, a big endian uint32 id and the body.
+// A reply carries the id of its request, so requests can be pipelined and answered out of order.
+type Frame struct {
+	Op   Op
+	Id   uint32
+	Body []byte
+}
+
+// ReadFrame reads the next frame, refusing frames over maxSize bytes
+func ReadFrame(r io.Reader, maxSize int) (Frame, error) {
+	var header [4 + frameHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return Frame{}, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < frameHeaderLength {
+		return Frame{}, fmt.Errorf("server: frame of %d bytes is too short", length)
+	}
+	if maxSize > 0 && int64(length) > int64(maxSize) {
+		return Frame{}, ErrFrameTooLarge
+	}
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return Frame{}, err
+	}
+	frame := Frame{Op: Op(header[4]), Id: binary.BigEndian.Uint32(header[5:]), Body: make([]byte, length-frameHeaderLength)}
+	if _, err := io.ReadFull(r, frame.Body); err != nil {
+		return Frame{}, err
+	}
+	return frame, nil
+}
+
+// WriteFrame writes the frame
+func WriteFrame(w io.Writer, frame Frame) error {
+	buf := make([]byte, 4+frameHeaderLength, 4+frameHeaderLength+len(frame.Body))
+	binary.BigEndian.PutUint32(buf, uint32(frameHeaderLength+len(frame.Body)))
+	buf[4] = byte(frame.Op)
+	binary.BigEndian.PutUint32(buf[5:], frame.Id)
+	_, err := w.Write(append(buf, frame.Body...))
+	return err
+}
+
+// AppendString appends a field of a uint32 length and the bytes of s to the body
+func AppendString(body []byte, s string) []byte {
+	body = AppendUint32(body, uint32(len(s)))
+	return append(body, s...)
+}
+
+// AppendInt64 appends a big endian int64 field to the body
+func AppendInt64(body []byte, n int64) []byte {
+	var field [8]byte
+	binary.BigEndian.PutUint64(field[:], uint64(n))
+	return append(body, field[:]...)
+}
+
+// AppendUint32 appends a big endian uint32 field to the body
+func AppendUint32(body []byte, n uint32) []byte {
+	var field [4]byte
+	binary.BigEndian.PutUint32(field[:], n)
+	return append(body, field[:]...)
+}
+
+// Decoder reads the fields of a body in order, after the first error every field reads as zero
+type Decoder struct {
+	body []byte
+	err  error
+}
+
+func NewDecoder(body []byte) *Decoder {
+	return &Decoder{body: body}
+}
+
+// Err is the first error, a body that ended early
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+func (d *Decoder) ReadString() string {
+	n := d.ReadUint32()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(n) > uint64(len(d.body)) {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(d.body[:n])
+	d.body = d.body[n:]
+	return s
+}
+
+func (d *Decoder) ReadInt64() int64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.body) < 8 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	n := int64(binary.BigEndian.Uint64(d.body))
+	d.body = d.body[8:]
+	return n
+}
+
+func (d *Decoder) ReadUint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.body) < 4 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	n := binary.BigEndian.Uint32(d.body)
+	d.body = d.body[4:]
+	return n
+}
@@ -0,0 +1,286 @@
+// Package server serves a PubySuby hub to other processes over TCP.
+//
+// The wire protocol is a stream of length prefixed binary frames, see Frame and the Op constants.
+// A client may pipeline requests without waiting for the replies, every reply carries the id of its request.
+// Blocking PULL and PULLSINCE requests wait at most MaxPullTimeout and are answered as their messages arrive, possibly out of order,
+// and at most MaxInFlight of them wait at once before the server stops reading from the connection.
+//
+// Messages of a SUB are delivered as MSG frames while fewer than Window of them are unacknowledged,
+// ACK n acknowledges n of them. MSG frames that cannot be sent wait in a queue of SendQueue frames,
+// a client that lets the queue overflow is disconnected.
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend"
+)
+
+// how many MSG frames may be unacknowledged unless the Server says otherwise
+const defaultWindow = 1024
+
+// how many MSG frames may wait to be sent unless the Server says otherwise
+const defaultSendQueue = 4096
+
+// how many pulls may wait at once unless the Server says otherwise
+const defaultMaxInFlight = 64
+
+// how long a pull may wait unless the Server says otherwise
+const defaultMaxPullTimeout = time.Second * 30
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("server: closed")
+
+// Server maps the wire protocol onto a hub
+type Server struct {
+	ps *pubysuby.PubySuby
+	// Window is how many MSG frames may be unacknowledged, 0 turns acknowledgements off
+	Window int
+	// SendQueue is how many MSG frames may wait to be sent before the client is disconnected
+	SendQueue int
+	// MaxInFlight is how many pulls of a connection may wait at once
+	MaxInFlight int
+	// MaxPullTimeout caps the timeout a pull may ask for
+	MaxPullTimeout time.Duration
+	// MaxFrameSize is the largest frame a client may send
+	MaxFrameSize int
+
+	front frontend.Server
+}
+
+// New creates a Server for the hub
+func New(ps *pubysuby.PubySuby) *Server {
+	return &Server{
+		ps:             ps,
+		Window:         defaultWindow,
+		SendQueue:      defaultSendQueue,
+		MaxInFlight:    defaultMaxInFlight,
+		MaxPullTimeout: defaultMaxPullTimeout,
+		MaxFrameSize:   DefaultMaxFrameSize,
+	}
+}
+
+// ListenAndServe listens on the TCP address and serves the connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until it fails or the Server is closed
+func (s *Server) Serve(l net.Listener) error {
+	return s.front.Serve(l, ErrServerClosed, func(netConn net.Conn) {
+		front := s.front.Add(netConn, s.SendQueue)
+		if front == nil {
+			return
+		}
+		c := &conn{
+			server:        s,
+			netConn:       netConn,
+			front:         front,
+			w:             bufio.NewWriter(netConn),
+			acks:          make(chan int64),
+			inFlight:      make(chan struct{}, s.MaxInFlight),
+			subscriptions: make(map[string]*frontend.Subscription),
+		}
+		c.serve()
+	})
+}
+
+// Close stops the listeners and closes every connection
+func (s *Server) Close() error {
+	s.front.Close()
+	return nil
+}
+
+// conn is the state of one connection.
+// The reading goroutine owns the subscriptions and answers the requests,
+// the delivering goroutine sends the MSG frames within the window.
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	// queues the MSG frames
+	front *frontend.Conn
+	mu    sync.Mutex
+	w     *bufio.Writer
+	acks  chan int64
+	// holds a token for every pull that waits
+	inFlight      chan struct{}
+	subscriptions map[string]*frontend.Subscription
+}
+
+// serve handles the client's requests until the connection closes, then it ends every subscription
+func (c *conn) serve() {
+	defer func() {
+		c.front.End()
+		for _, sub := range c.subscriptions {
+			sub.Unsubscribe()
+		}
+	}()
+	go c.writeDeliveries()
+	r := bufio.NewReader(c.netConn)
+	for {
+		frame, err := ReadFrame(r, c.server.MaxFrameSize)
+		if err != nil {
+			return
+		}
+		if err := c.handle(frame); err != nil {
+			c.reply(Frame{Op: OpErr, Id: frame.Id, Body: AppendString(nil, err.Error())})
+		}
+	}
+}
+
+func (c *conn) handle(frame Frame) error {
+	d := NewDecoder(frame.Body)
+	switch frame.Op {
+	case OpPub:
+		topic, message := d.ReadString(), d.ReadString()
+		if d.Err() != nil {
+			return badBody(frame.Op, d.Err())
+		}
+		id := c.server.ps.Push(topic, message)
+		c.reply(Frame{Op: OpOk, Id: frame.Id, Body: AppendInt64(nil, id)})
+	case OpSub:
+		topicName := d.ReadString()
+		if d.Err() != nil {
+			return badBody(frame.Op, d.Err())
+		}
+		if _, ok := c.subscriptions[topicName]; ok {
+			return fmt.Errorf("already subscribed to %q", topicName)
+		}
+		sub := frontend.Subscribe(c.server.ps.Topic(topicName))
+		c.subscriptions[topicName] = sub
+		// answer before the first delivery
+		c.reply(Frame{Op: OpOk, Id: frame.Id})
+		go c.forward(sub, frame.Id)
+	case OpUnsub:
+		topicName := d.ReadString()
+		if d.Err() != nil {
+			return badBody(frame.Op, d.Err())
+		}
+		sub, ok := c.subscriptions[topicName]
+		if !ok {
+			return fmt.Errorf("not subscribed to %q", topicName)
+		}
+		delete(c.subscriptions, topicName)
+		sub.Unsubscribe()
+		c.reply(Frame{Op: OpOk, Id: frame.Id})
+	case OpPull, OpPullSince:
+		topic := d.ReadString()
+		var since int64
+		if frame.Op == OpPullSince {
+			since = d.ReadInt64()
+		}
+		timeout := d.ReadInt64()
+		if d.Err() != nil {
+			return badBody(frame.Op, d.Err())
+		}
+		if max := int64(c.server.MaxPullTimeout / time.Millisecond); timeout > max {
+			timeout = max
+		}
+		// wait for a free slot, so a client cannot pile up pulls
+		select {
+		case c.inFlight <- struct{}{}:
+		case <-c.front.Done():
+			return nil
+		}
+		go func() {
+			defer func() { <-c.inFlight }()
+			// a closed connection stops the pull instead of holding its listener until the timeout
+			items := c.server.ps.Topic(topic).PullSinceUntil(c.front.Done(), timeout, since)
+			body := AppendUint32(nil, uint32(len(items)))
+			for _, item := range items {
+				body = appendItem(body, item)
+			}
+			c.reply(Frame{Op: OpItems, Id: frame.Id, Body: body})
+		}()
+	case OpLastId:
+		topic := d.ReadString()
+		if d.Err() != nil {
+			return badBody(frame.Op, d.Err())
+		}
+		c.reply(Frame{Op: OpOk, Id: frame.Id, Body: AppendInt64(nil, c.server.ps.LastMessageId(topic))})
+	case OpAck:
+		count := d.ReadUint32()
+		if d.Err() != nil {
+			return badBody(frame.Op, d.Err())
+		}
+		select {
+		case c.acks <- int64(count):
+		case <-c.front.Done():
+		}
+	case OpPing:
+		c.reply(Frame{Op: OpPong, Id: frame.Id})
+	default:
+		return fmt.Errorf("unknown op %d", frame.Op)
+	}
+	return nil
+}
+
+// forward queues the subscription's messages as MSG frames with the id of the SUB
+func (c *conn) forward(sub *frontend.Subscription, id uint32) {
+	sub.Forward(frontend.Replay{}, func(item pubysuby.TopicItem) {
+		body := appendItem(AppendString(nil, sub.Topic.Name()), item)
+		c.front.Deliver(Frame{Op: OpMsg, Id: id, Body: body})
+	})
+}
+
+// writeDeliveries sends the queued MSG frames while fewer than Window are unacknowledged
+func (c *conn) writeDeliveries() {
+	var unacked int64
+	window := int64(c.server.Window)
+	for {
+		deliveries := c.front.Deliveries
+		if window > 0 && unacked >= window {
+			deliveries = nil
+		}
+		select {
+		case <-c.front.Done():
+			return
+		case count := <-c.acks:
+			if unacked -= count; unacked < 0 {
+				unacked = 0
+			}
+		case frame := <-deliveries:
+			unacked++
+			if err := c.write(frame.(Frame)); err != nil {
+				c.front.Close()
+				return
+			}
+		}
+	}
+}
+
+// reply sends an answer to a request, answers are not held back by the window
+func (c *conn) reply(frame Frame) {
+	if err := c.write(frame); err != nil {
+		c.front.Close()
+	}
+}
+
+func (c *conn) write(frame Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := WriteFrame(c.w, frame); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func appendItem(body []byte, item pubysuby.TopicItem) []byte {
+	body = AppendInt64(body, item.MessageId)
+	body = AppendInt64(body, item.CreatedTime.UnixNano())
+	return AppendString(body, item.Message)
+}
+
+func badBody(op Op, err error) error {
+	return fmt.Errorf("bad body for op %d: %v", op, err)
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend/frontendtest"
+)
+
+type testClient struct {
+	*frontendtest.Conn
+}
+
+// start serves the server and connects a client to it
+func start(t *testing.T, server *Server) *testClient {
+	return &testClient{frontendtest.Dial(t, frontendtest.Listen(t, server))}
+}
+
+func (c *testClient) send(op Op, id uint32, body []byte) {
+	if err := WriteFrame(c, Frame{Op: op, Id: id, Body: body}); err != nil {
+		c.T.Fatal(err)
+	}
+}
+
+func (c *testClient) receive() Frame {
+	frame, err := ReadFrame(c.Reader(), 0)
+	if err != nil {
+		c.T.Fatal(err)
+	}
+	return frame
+}
+
+func TestPipelining(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	client := start(t, New(ps))
+
+	// the pull waits for a message, the ping behind it is answered first
+	client.send(OpPull, 1, AppendInt64(AppendString(nil, "test"), 1000))
+	client.send(OpPing, 2, nil)
+	if frame := client.receive(); frame.Op != OpPong || frame.Id != 2 {
+		t.Fatalf("Expected the pong before the waiting pull, got %+v", frame)
+	}
+
+	client.send(OpPub, 3, AppendString(AppendString(nil, "test"), "hello"))
+	for i := 0; i < 2; i++ {
+		frame := client.receive()
+		d := NewDecoder(frame.Body)
+		switch frame.Id {
+		case 1:
+			if count := d.ReadUint32(); frame.Op != OpItems || count != 1 {
+				t.Errorf("Expected the pull to return one item, got %+v", frame)
+			}
+			if id, _, message := d.ReadInt64(), d.ReadInt64(), d.ReadString(); id != 1 || message != "hello" {
+				t.Errorf("Expected message 1 hello, got %d %q", id, message)
+			}
+		case 3:
+			if id := d.ReadInt64(); frame.Op != OpOk || id != 1 {
+				t.Errorf("Expected the publish to return id 1, got %+v", frame)
+			}
+		default:
+			t.Errorf("Unexpected frame %+v", frame)
+		}
+	}
+
+	client.send(OpPullSince, 4, AppendInt64(AppendInt64(AppendString(nil, "test"), 1), 1))
+	if frame := client.receive(); frame.Op != OpItems || NewDecoder(frame.Body).ReadUint32() != 0 {
+		t.Errorf("Expected no items after the last message, got %+v", frame)
+	}
+	client.send(OpLastId, 5, AppendString(nil, "test"))
+	if frame := client.receive(); frame.Op != OpOk || NewDecoder(frame.Body).ReadInt64() != 1 {
+		t.Errorf("Expected the last message id 1, got %+v", frame)
+	}
+	client.send(Op(99), 6, nil)
+	if frame := client.receive(); frame.Op != OpErr || frame.Id != 6 {
+		t.Errorf("Expected an error for an unknown op, got %+v", frame)
+	}
+	client.send(OpPub, 7, AppendString(nil, "test"))
+	if frame := client.receive(); frame.Op != OpErr || frame.Id != 7 {
+		t.Errorf("Expected an error for a short body, got %+v", frame)
+	}
+}
+
+func TestSubWindow(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.Window = 1
+	client := start(t, server)
+
+	client.send(OpSub, 1, AppendString(nil, "test"))
+	if frame := client.receive(); frame.Op != OpOk || frame.Id != 1 {
+		t.Fatalf("Expected the sub to be answered, got %+v", frame)
+	}
+	ps.Push("test", "first")
+	ps.Push("test", "second")
+	frame := client.receive()
+	d := NewDecoder(frame.Body)
+	if topic, id := d.ReadString(), d.ReadInt64(); frame.Op != OpMsg || frame.Id != 1 || topic != "test" || id != 1 {
+		t.Fatalf("Expected the first message, got %+v", frame)
+	}
+	// the second message waits for the ack, so the pong comes first
+	client.send(OpPing, 2, nil)
+	if frame := client.receive(); frame.Op != OpPong {
+		t.Fatalf("Expected the pong before the unacknowledged message, got %+v", frame)
+	}
+	client.send(OpAck, 0, AppendUint32(nil, 1))
+	frame = client.receive()
+	d = NewDecoder(frame.Body)
+	if _, id := d.ReadString(), d.ReadInt64(); frame.Op != OpMsg || id != 2 {
+		t.Errorf("Expected the second message after the ack, got %+v", frame)
+	}
+
+	client.Close()
+	frontendtest.WaitForSubscribers(t, ps, "test", 0)
+}
+
+func TestPullLimits(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.MaxPullTimeout = time.Millisecond * 50
+	client := start(t, server)
+
+	started := time.Now()
+	client.send(OpPull, 1, AppendInt64(AppendString(nil, "capped"), 60000))
+	if frame := client.receive(); frame.Op != OpItems || time.Since(started) > time.Second*2 {
+		t.Errorf("Expected the pull to time out after MaxPullTimeout, got %+v after %v", frame, time.Since(started))
+	}
+
+	waiting := start(t, New(ps))
+	waiting.send(OpPull, 2, AppendInt64(AppendString(nil, "test"), 60000))
+	frontendtest.WaitForPullers(t, ps, "test", 1)
+	waiting.Close()
+	frontendtest.WaitForPullers(t, ps, "test", 0)
+}
+
+func TestReadFrameLimits(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	WriteFrame(&buf, Frame{Op: OpPub, Id: 1, Body: make([]byte, 100)})
+	if _, err := ReadFrame(&buf, 50); err != ErrFrameTooLarge {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+	d := NewDecoder(AppendUint32(nil, 10))
+	if s := d.ReadString(); s != "" || d.Err() == nil {
+		t.Errorf("Expected a string longer than the body to fail, got %q %v", s, d.Err())
+	}
+}
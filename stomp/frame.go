@@ -0,0 +1,193 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxFrameSize is the largest frame the Server accepts unless it says otherwise
+const DefaultMaxFrameSize = 1 << 20
+
+// ErrFrameTooLarge is returned for a frame over the maximum size
+var ErrFrameTooLarge = errors.New("stomp: frame too large")
+
+// ErrMalformed is returned for a frame that breaks the protocol
+var ErrMalformed = errors.New("stomp: malformed frame")
+
+// Frame is a STOMP frame. A heart-beat reads as a Frame without a Command.
+type Frame struct {
+	Command string
+	// Headers keep the first value of a repeated header, as STOMP 1.2 requires
+	Headers map[string]string
+	Body    []byte
+}
+
+// ReadFrame reads the next frame or heart-beat, refusing frames over maxSize bytes
+func ReadFrame(r *bufio.Reader, maxSize int) (Frame, error) {
+	var f Frame
+	size := 0
+	line, err := readLine(r, maxSize, &size)
+	if err != nil {
+		return f, err
+	}
+	if line == "" {
+		// a heart-beat, or the optional EOL after the previous frame
+		return f, nil
+	}
+	f.Command = line
+	f.Headers = make(map[string]string)
+	// the headers of CONNECT and CONNECTED are not escaped, for compatibility with STOMP 1.0
+	escaped := f.Command != "CONNECT" && f.Command != "CONNECTED"
+	for {
+		line, err := readLine(r, maxSize, &size)
+		if err != nil {
+			return f, err
+		}
+		if line == "" {
+			break
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return f, ErrMalformed
+		}
+		name, value := line[:colon], line[colon+1:]
+		if escaped {
+			if name, err = unescape(name); err != nil {
+				return f, err
+			}
+			if value, err = unescape(value); err != nil {
+				return f, err
+			}
+		}
+		if _, ok := f.Headers[name]; !ok {
+			f.Headers[name] = value
+		}
+	}
+
+	if contentLength, ok := f.Headers["content-length"]; ok {
+		length, err := strconv.Atoi(contentLength)
+		if err != nil || length < 0 {
+			return f, ErrMalformed
+		}
+		if maxSize > 0 && size+length > maxSize {
+			return f, ErrFrameTooLarge
+		}
+		f.Body = make([]byte, length+1)
+		if _, err := io.ReadFull(r, f.Body); err != nil {
+			return f, err
+		}
+		if f.Body[length] != 0 {
+			return f, ErrMalformed
+		}
+		f.Body = f.Body[:length]
+		return f, nil
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return f, err
+		}
+		if b == 0 {
+			return f, nil
+		}
+		size++
+		if maxSize > 0 && size > maxSize {
+			return f, ErrFrameTooLarge
+		}
+		f.Body = append(f.Body, b)
+	}
+}
+
+// readLine reads a line ending with LF or CRLF, counting its bytes into size
+func readLine(r *bufio.Reader, maxSize int, size *int) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		*size++
+		if maxSize > 0 && *size > maxSize {
+			return "", ErrFrameTooLarge
+		}
+		if b == '\n' {
+			return string(bytes.TrimSuffix(line, []byte{'\r'})), nil
+		}
+		line = append(line, b)
+	}
+}
+
+// WriteFrame writes the frame, or a heart-beat for a Frame without a Command, with a single Write
+func WriteFrame(w io.Writer, f Frame) error {
+	_, err := w.Write(AppendFrame(nil, f))
+	return err
+}
+
+// AppendFrame appends the encoded frame, its headers in name order
+func AppendFrame(buf []byte, f Frame) []byte {
+	if f.Command == "" {
+		return append(buf, '\n')
+	}
+	buf = append(buf, f.Command...)
+	buf = append(buf, '\n')
+	names := make([]string, 0, len(f.Headers))
+	for name := range f.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	escaped := f.Command != "CONNECT" && f.Command != "CONNECTED"
+	for _, name := range names {
+		value := f.Headers[name]
+		if escaped {
+			name, value = escape(name), escape(value)
+		}
+		buf = append(buf, name...)
+		buf = append(buf, ':')
+		buf = append(buf, value...)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, '\n')
+	buf = append(buf, f.Body...)
+	return append(buf, 0)
+}
+
+var escaper = strings.NewReplacer("\\", `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// unescape decodes the escape sequences of a header, any other sequence is an error
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", ErrMalformed
+		}
+		switch s[i] {
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			return "", ErrMalformed
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,590 @@
+// Package stomp serves a PubySuby hub to STOMP 1.2 clients over TCP and over WebSocket,
+// so Java and browser components share the topics of the Go services.
+//
+// A destination names a topic, with or without the "/topic/" prefix: "/topic/chat" and "chat" are the topic chat.
+// SEND publishes the body, its headers other than the STOMP ones becoming the message headers.
+// SUBSCRIBE delivers the messages of the topic as MESSAGE frames carrying the message headers,
+// a "selector" header filters them with a pubysuby.ParseFilter expression such as headers.region == "eu".
+// With the client and client-individual ack modes at most Window messages are unacknowledged per connection,
+// ACK and NACK both release them, as a topic has no queue a NACKed message could go back to.
+// Transactions are not supported.
+//
+// Every frame may ask for a RECEIPT, heart-beats are negotiated from the Server's HeartBeat
+// and a client that misses two of its heart-beat periods is disconnected.
+// Deliveries that cannot be sent wait in a queue of SendQueue messages, a client that lets it overflow is disconnected.
+package stomp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend"
+	"github.com/rambocoder/pubysuby/websocket"
+)
+
+// defaults of the Server's settings
+const (
+	defaultWindow         = 64
+	defaultSendQueue      = 4096
+	defaultHeartBeat      = time.Second * 10
+	defaultConnectTimeout = time.Second * 10
+)
+
+// the WebSocket subprotocol of STOMP 1.2
+const subprotocol = "v12.stomp"
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("stomp: server closed")
+
+// Server speaks STOMP for a hub, on its listeners and as an http.Handler upgrading to WebSocket
+type Server struct {
+	ps *pubysuby.PubySuby
+	// Window is how many messages may be unacknowledged, 0 turns the limit off
+	Window int
+	// SendQueue is how many messages may wait to be sent before a client is disconnected
+	SendQueue int
+	// HeartBeat is how often the server offers to send heart-beats and asks the clients to, 0 turns them off
+	HeartBeat time.Duration
+	// ConnectTimeout is how long a new connection may take to send its CONNECT
+	ConnectTimeout time.Duration
+	// MaxFrameSize is the largest frame a client may send
+	MaxFrameSize int
+	// Authenticate decides whether the login and passcode of a CONNECT may connect, nil lets every client connect
+	Authenticate func(login string, passcode string) bool
+	// CheckOrigin reports whether a WebSocket handshake from the request's Origin is accepted,
+	// nil accepts websocket.SameOrigin requests only
+	CheckOrigin func(r *http.Request) bool
+
+	front  frontend.Server
+	mu     sync.Mutex
+	nextId int64
+}
+
+// New creates a Server for the hub
+func New(ps *pubysuby.PubySuby) *Server {
+	return &Server{
+		ps:             ps,
+		Window:         defaultWindow,
+		SendQueue:      defaultSendQueue,
+		HeartBeat:      defaultHeartBeat,
+		ConnectTimeout: defaultConnectTimeout,
+		MaxFrameSize:   DefaultMaxFrameSize,
+	}
+}
+
+// ListenAndServe listens on the TCP address, such as ":61613", and serves the connections
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until it fails or the Server is closed
+func (s *Server) Serve(l net.Listener) error {
+	return s.front.Serve(l, ErrServerClosed, func(netConn net.Conn) {
+		s.serveStream(netConn)
+	})
+}
+
+// ServeHTTP upgrades the request to a WebSocket with the v12.stomp subprotocol and serves it,
+// every WebSocket message carries one frame or heart-beat.
+// Cross origin handshakes are refused unless CheckOrigin accepts them.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := (&websocket.Upgrader{CheckOrigin: s.CheckOrigin}).Upgrade(w, r, subprotocol)
+	if err != nil {
+		return
+	}
+	if s.MaxFrameSize > 0 {
+		ws.MaxMessageSize = int64(s.MaxFrameSize)
+	}
+	s.serveStream(&wsStream{conn: ws})
+}
+
+// Close stops the listeners and closes every connection
+func (s *Server) Close() error {
+	s.front.Close()
+	return nil
+}
+
+func (s *Server) serveStream(stream stream) {
+	front := s.front.Add(stream, s.SendQueue)
+	if front == nil {
+		return
+	}
+	c := &conn{
+		server:        s,
+		stream:        stream,
+		front:         front,
+		releases:      make(chan release),
+		subscriptions: make(map[string]*subscription),
+	}
+	c.serve()
+}
+
+// stream is what a connection runs on, a TCP connection or a WebSocket
+type stream interface {
+	io.Reader
+	io.Writer
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// wsStream reads the WebSocket messages as one byte stream and writes every Write as a message
+type wsStream struct {
+	conn *websocket.Conn
+	buf  []byte
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		s.buf = data
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	if err := s.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *wsStream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *wsStream) Close() error {
+	return s.conn.Close()
+}
+
+// subscription is a SUBSCRIBE of the connection
+type subscription struct {
+	id          string
+	destination string
+	ack         string
+	sub         *frontend.Subscription
+	// closed by UNSUBSCRIBE, the messages still queued for the subscription are dropped
+	stopped chan struct{}
+}
+
+// delivery is a message queued for a subscription
+type delivery struct {
+	subscription *subscription
+	item         pubysuby.TopicItem
+}
+
+// release frees the window from the acknowledged message seq, or from every message of the subscription when seq is 0
+type release struct {
+	subscription *subscription
+	seq          int64
+}
+
+// pending is an unacknowledged message
+type pending struct {
+	subscription *subscription
+	// an ACK of a client mode subscription acknowledges its earlier messages too
+	cumulative bool
+}
+
+// conn is the state of one connection.
+// The reading goroutine handles the client's frames,
+// the delivering goroutine sends the messages within the window and the heart-beats.
+type conn struct {
+	server *Server
+	stream stream
+
+	mu sync.Mutex
+	// whether anything was sent since the last heart-beat tick
+	wrote bool
+
+	// queues the deliveries
+	front    *frontend.Conn
+	releases chan release
+	// key: subscription id, owned by the reading goroutine
+	subscriptions map[string]*subscription
+}
+
+// serve handles the client's frames until the connection closes, then it ends the subscriptions
+func (c *conn) serve() {
+	defer func() {
+		c.front.End()
+		for _, s := range c.subscriptions {
+			s.sub.Unsubscribe()
+		}
+	}()
+
+	r := bufio.NewReader(c.stream)
+	c.stream.SetReadDeadline(time.Now().Add(c.server.ConnectTimeout))
+	var f Frame
+	var err error
+	for f.Command == "" {
+		if f, err = ReadFrame(r, c.server.MaxFrameSize); err != nil {
+			c.readFailed(err)
+			return
+		}
+	}
+	if f.Command != "CONNECT" && f.Command != "STOMP" {
+		c.fail(f, "expected a CONNECT frame")
+		return
+	}
+	receiveEvery, sendEvery, ok := c.connect(f)
+	if !ok {
+		return
+	}
+	go c.writeDeliveries(sendEvery)
+	for {
+		var deadline time.Time
+		if receiveEvery > 0 {
+			// the client may miss one heart-beat
+			deadline = time.Now().Add(receiveEvery * 2)
+		}
+		c.stream.SetReadDeadline(deadline)
+		f, err := ReadFrame(r, c.server.MaxFrameSize)
+		if err != nil {
+			c.readFailed(err)
+			return
+		}
+		if f.Command != "" && !c.handle(f) {
+			return
+		}
+	}
+}
+
+// readFailed tells the client about a frame it got wrong
+func (c *conn) readFailed(err error) {
+	if err == ErrMalformed || err == ErrFrameTooLarge {
+		c.fail(Frame{}, err.Error())
+	}
+}
+
+// connect answers the CONNECT with CONNECTED and returns the negotiated heart-beat periods,
+// it returns false when the connection is refused
+func (c *conn) connect(f Frame) (time.Duration, time.Duration, bool) {
+	supported := false
+	for _, version := range strings.Split(f.Headers["accept-version"], ",") {
+		supported = supported || strings.TrimSpace(version) == "1.2"
+	}
+	if !supported {
+		c.fail(f, "only STOMP 1.2 is supported", "version", "1.2")
+		return 0, 0, false
+	}
+	if c.server.Authenticate != nil && !c.server.Authenticate(f.Headers["login"], f.Headers["passcode"]) {
+		c.fail(f, "access refused")
+		return 0, 0, false
+	}
+	canSend, wantsReceive, err := parseHeartBeat(f.Headers["heart-beat"])
+	if err != nil {
+		c.fail(f, err.Error())
+		return 0, 0, false
+	}
+	var receiveEvery, sendEvery time.Duration
+	if beat := c.server.HeartBeat; beat > 0 {
+		if canSend > 0 {
+			receiveEvery = maxDuration(beat, canSend)
+		}
+		if wantsReceive > 0 {
+			sendEvery = maxDuration(beat, wantsReceive)
+		}
+	}
+
+	c.server.mu.Lock()
+	c.server.nextId++
+	session := fmt.Sprintf("pubysuby-%d", c.server.nextId)
+	c.server.mu.Unlock()
+	beat := strconv.FormatInt(int64(c.server.HeartBeat/time.Millisecond), 10)
+	err = c.write(Frame{Command: "CONNECTED", Headers: map[string]string{
+		"version":    "1.2",
+		"heart-beat": beat + "," + beat,
+		"server":     "pubysuby",
+		"session":    session,
+	}})
+	return receiveEvery, sendEvery, err == nil
+}
+
+// parseHeartBeat parses the heart-beat header, "0,0" when missing
+func parseHeartBeat(header string) (time.Duration, time.Duration, error) {
+	if header == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(header, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid heart-beat %q", header)
+	}
+	var periods [2]time.Duration
+	for i, part := range parts {
+		ms, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || ms < 0 {
+			return 0, 0, fmt.Errorf("invalid heart-beat %q", header)
+		}
+		periods[i] = time.Duration(ms) * time.Millisecond
+	}
+	return periods[0], periods[1], nil
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// handle answers the frame, it returns false when the connection is to be closed
+func (c *conn) handle(f Frame) bool {
+	switch f.Command {
+	case "SEND":
+		destination := f.Headers["destination"]
+		if destination == "" {
+			return c.fail(f, "missing destination header")
+		}
+		if _, ok := f.Headers["transaction"]; ok {
+			return c.fail(f, "transactions are not supported")
+		}
+		var headers map[string]string
+		for name, value := range f.Headers {
+			switch name {
+			case "destination", "content-length", "content-type", "receipt":
+			default:
+				if headers == nil {
+					headers = make(map[string]string)
+				}
+				headers[name] = value
+			}
+		}
+		topic := c.server.ps.Topic(topicName(destination))
+		if _, err := topic.PushWithOptions(string(f.Body), pubysuby.PushOptions{Headers: headers}); err != nil {
+			return c.fail(f, err.Error())
+		}
+	case "SUBSCRIBE":
+		if !c.subscribe(f) {
+			return false
+		}
+	case "UNSUBSCRIBE":
+		s, ok := c.subscriptions[f.Headers["id"]]
+		if !ok {
+			return c.fail(f, "no subscription with this id")
+		}
+		delete(c.subscriptions, s.id)
+		close(s.stopped)
+		s.sub.Unsubscribe()
+		if !c.release(release{subscription: s}) {
+			return false
+		}
+	case "ACK", "NACK":
+		seq, err := strconv.ParseInt(f.Headers["id"], 10, 64)
+		if err != nil || seq <= 0 {
+			return c.fail(f, "invalid id header")
+		}
+		if !c.release(release{seq: seq}) {
+			return false
+		}
+	case "BEGIN", "COMMIT", "ABORT":
+		return c.fail(f, "transactions are not supported")
+	case "DISCONNECT":
+		c.receipt(f)
+		return false
+	default:
+		return c.fail(f, "unknown command "+f.Command)
+	}
+	return c.receipt(f)
+}
+
+// topicName is the topic of a destination
+func topicName(destination string) string {
+	return strings.TrimPrefix(destination, "/topic/")
+}
+
+func (c *conn) subscribe(f Frame) bool {
+	id, destination := f.Headers["id"], f.Headers["destination"]
+	if id == "" || destination == "" {
+		return c.fail(f, "missing id or destination header")
+	}
+	if _, ok := c.subscriptions[id]; ok {
+		return c.fail(f, "subscription id already in use")
+	}
+	ack := f.Headers["ack"]
+	switch ack {
+	case "":
+		ack = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return c.fail(f, "invalid ack header")
+	}
+	var filters []pubysuby.Filter
+	if selector := f.Headers["selector"]; selector != "" {
+		expression, err := pubysuby.ParseFilter(selector)
+		if err != nil {
+			return c.fail(f, err.Error())
+		}
+		filters = append(filters, expression)
+	}
+	s := &subscription{
+		id:          id,
+		destination: destination,
+		ack:         ack,
+		sub:         frontend.Subscribe(c.server.ps.Topic(topicName(destination)), filters...),
+		stopped:     make(chan struct{}),
+	}
+	c.subscriptions[id] = s
+	go c.forward(s)
+	return true
+}
+
+// forward queues the subscription's messages
+func (c *conn) forward(s *subscription) {
+	s.sub.Forward(frontend.Replay{}, func(item pubysuby.TopicItem) {
+		c.front.Deliver(delivery{subscription: s, item: item})
+	})
+}
+
+func (c *conn) release(r release) bool {
+	select {
+	case c.releases <- r:
+		return true
+	case <-c.front.Done():
+		return false
+	}
+}
+
+// writeDeliveries sends the queued messages while fewer than Window are unacknowledged,
+// and a heart-beat every sendEvery that nothing else was sent
+func (c *conn) writeDeliveries(sendEvery time.Duration) {
+	var heartBeats <-chan time.Time
+	if sendEvery > 0 {
+		// ticking twice a period, nothing is sent for at most a period
+		ticker := time.NewTicker(sendEvery / 2)
+		defer ticker.Stop()
+		heartBeats = ticker.C
+	}
+	unacknowledged := make(map[int64]pending)
+	var seq int64
+	for {
+		deliveries := c.front.Deliveries
+		if c.server.Window > 0 && len(unacknowledged) >= c.server.Window {
+			deliveries = nil
+		}
+		select {
+		case <-c.front.Done():
+			return
+		case r := <-c.releases:
+			if r.seq == 0 {
+				for s, p := range unacknowledged {
+					if p.subscription == r.subscription {
+						delete(unacknowledged, s)
+					}
+				}
+			} else if acknowledged, ok := unacknowledged[r.seq]; ok {
+				delete(unacknowledged, r.seq)
+				if acknowledged.cumulative {
+					for s, p := range unacknowledged {
+						if p.subscription == acknowledged.subscription && s < r.seq {
+							delete(unacknowledged, s)
+						}
+					}
+				}
+			}
+		case queued := <-deliveries:
+			d := queued.(delivery)
+			seq++
+			sent, err := c.sendMessage(d, seq)
+			if err != nil {
+				c.front.Close()
+				return
+			}
+			if sent && d.subscription.ack != "auto" {
+				unacknowledged[seq] = pending{subscription: d.subscription, cumulative: d.subscription.ack == "client"}
+			}
+		case <-heartBeats:
+			c.mu.Lock()
+			var err error
+			if !c.wrote {
+				err = WriteFrame(c.stream, Frame{})
+			}
+			c.wrote = false
+			c.mu.Unlock()
+			if err != nil {
+				c.front.Close()
+				return
+			}
+		}
+	}
+}
+
+// sendMessage writes the MESSAGE frame unless the subscription was unsubscribed,
+// checking under the lock so nothing follows the RECEIPT of the UNSUBSCRIBE
+func (c *conn) sendMessage(d delivery, seq int64) (bool, error) {
+	headers := make(map[string]string, len(d.item.Headers)+5)
+	for name, value := range d.item.Headers {
+		headers[name] = value
+	}
+	id := strconv.FormatInt(seq, 10)
+	headers["destination"] = d.subscription.destination
+	headers["subscription"] = d.subscription.id
+	headers["message-id"] = id
+	headers["content-length"] = strconv.Itoa(len(d.item.Message))
+	if d.subscription.ack != "auto" {
+		headers["ack"] = id
+	}
+	buf := AppendFrame(nil, Frame{Command: "MESSAGE", Headers: headers, Body: []byte(d.item.Message)})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-d.subscription.stopped:
+		return false, nil
+	default:
+	}
+	c.wrote = true
+	_, err := c.stream.Write(buf)
+	return true, err
+}
+
+// receipt answers the frame's receipt header
+func (c *conn) receipt(f Frame) bool {
+	receipt, ok := f.Headers["receipt"]
+	if !ok {
+		return true
+	}
+	return c.write(Frame{Command: "RECEIPT", Headers: map[string]string{"receipt-id": receipt}}) == nil
+}
+
+// fail sends an ERROR about the frame and closes the connection, as STOMP requires, it returns false
+func (c *conn) fail(f Frame, message string, headers ...string) bool {
+	errorFrame := Frame{Command: "ERROR", Headers: map[string]string{"message": message}}
+	if receipt, ok := f.Headers["receipt"]; ok {
+		errorFrame.Headers["receipt-id"] = receipt
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		errorFrame.Headers[headers[i]] = headers[i+1]
+	}
+	c.write(errorFrame)
+	c.front.Close()
+	return false
+}
+
+func (c *conn) write(f Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wrote = true
+	return WriteFrame(c.stream, f)
+}
@@ -0,0 +1,294 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend/frontendtest"
+	"github.com/rambocoder/pubysuby/websocket"
+)
+
+type testClient struct {
+	*frontendtest.Conn
+}
+
+func dial(t *testing.T, l net.Listener) *testClient {
+	return &testClient{frontendtest.Dial(t, l)}
+}
+
+// connect sends a STOMP 1.2 CONNECT and returns the answer
+func (c *testClient) connect(headers ...string) Frame {
+	return c.do("CONNECT", append([]string{"accept-version", "1.0,1.2", "host", "localhost"}, headers...)...)
+}
+
+// do sends the frame and reads the answer
+func (c *testClient) do(command string, headers ...string) Frame {
+	c.send(command, "", headers...)
+	return c.receive()
+}
+
+func (c *testClient) send(command string, body string, headers ...string) {
+	f := Frame{Command: command, Headers: make(map[string]string), Body: []byte(body)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.Headers[headers[i]] = headers[i+1]
+	}
+	if err := WriteFrame(c, f); err != nil {
+		c.T.Fatal(err)
+	}
+}
+
+// receive reads the next frame, skipping heart-beats
+func (c *testClient) receive() Frame {
+	for {
+		f, err := ReadFrame(c.Reader(), 0)
+		if err != nil {
+			c.T.Fatal(err)
+		}
+		if f.Command != "" {
+			return f
+		}
+	}
+}
+
+// expectFrame checks the command, the body and the given headers of the frame
+func expectFrame(t *testing.T, f Frame, command string, body string, headers ...string) {
+	t.Helper()
+	if f.Command != command || string(f.Body) != body {
+		t.Errorf("Expected %s %q, got %s %q %v", command, body, f.Command, f.Body, f.Headers)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		if got := f.Headers[headers[i]]; got != headers[i+1] {
+			t.Errorf("Expected %s:%s in %s, got %q", headers[i], headers[i+1], f.Command, got)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	l := frontendtest.Listen(t, New(ps))
+	client := dial(t, l)
+
+	expectFrame(t, client.connect(), "CONNECTED", "", "version", "1.2", "server", "pubysuby")
+	expectFrame(t, client.do("SUBSCRIBE", "id", "0", "destination", "/topic/chat", "receipt", "r1"), "RECEIPT", "", "receipt-id", "r1")
+	ps.Push("chat", "hi")
+	expectFrame(t, client.receive(), "MESSAGE", "hi", "destination", "/topic/chat", "subscription", "0", "content-length", "2")
+
+	expectFrame(t, client.do("SUBSCRIBE", "id", "eu", "destination", "chat", "selector", `headers.region == "eu"`, "receipt", "r2"),
+		"RECEIPT", "", "receipt-id", "r2")
+	client.send("SEND", "bonjour", "destination", "/topic/chat", "region", "eu", "receipt", "r3")
+	// the RECEIPT and the MESSAGE frames are sent by different goroutines
+	frames := []Frame{client.receive(), client.receive(), client.receive()}
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].Command+frames[i].Headers["subscription"] < frames[j].Command+frames[j].Headers["subscription"]
+	})
+	expectFrame(t, frames[0], "MESSAGE", "bonjour", "subscription", "0", "region", "eu")
+	expectFrame(t, frames[1], "MESSAGE", "bonjour", "subscription", "eu", "destination", "chat")
+	expectFrame(t, frames[2], "RECEIPT", "", "receipt-id", "r3")
+	if headers := ps.Topic("chat").History(pubysuby.HistoryQuery{}).Items[1].Headers; !reflect.DeepEqual(headers, map[string]string{"region": "eu"}) {
+		t.Errorf("Expected the SEND's headers on the message, got %v", headers)
+	}
+
+	expectFrame(t, client.do("UNSUBSCRIBE", "id", "0", "receipt", "r4"), "RECEIPT", "", "receipt-id", "r4")
+	ps.Push("chat", "only eu")
+	ps.Push("chat", "eu again")
+	expectFrame(t, client.do("DISCONNECT", "receipt", "r5"), "RECEIPT", "", "receipt-id", "r5")
+	frontendtest.WaitForSubscribers(t, ps, "chat", 0)
+}
+
+func TestAck(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.Window = 2
+	l := frontendtest.Listen(t, server)
+	client := dial(t, l)
+	client.connect()
+
+	expectFrame(t, client.do("SUBSCRIBE", "id", "0", "destination", "orders", "ack", "client", "receipt", "r1"), "RECEIPT", "")
+	for _, message := range []string{"1", "2", "3", "4", "5"} {
+		ps.Push("orders", message)
+	}
+	first, second := client.receive(), client.receive()
+	expectFrame(t, first, "MESSAGE", "1")
+	expectFrame(t, second, "MESSAGE", "2")
+	// the window is full, the third message waits
+	expectFrame(t, client.do("SUBSCRIBE", "id", "1", "destination", "other", "ack", "client-individual", "receipt", "r2"), "RECEIPT", "")
+
+	// the ACK of a client subscription acknowledges the earlier messages too
+	client.send("ACK", "", "id", second.Headers["ack"])
+	third, fourth := client.receive(), client.receive()
+	expectFrame(t, third, "MESSAGE", "3")
+	expectFrame(t, fourth, "MESSAGE", "4")
+	client.send("NACK", "", "id", third.Headers["ack"])
+	expectFrame(t, client.receive(), "MESSAGE", "5")
+
+	// client-individual acknowledges one message
+	ps.Push("other", "a")
+	expectFrame(t, client.do("ACK", "id", fourth.Headers["ack"], "receipt", "r3"), "RECEIPT", "", "receipt-id", "r3")
+	expectFrame(t, client.receive(), "MESSAGE", "a", "subscription", "1")
+}
+
+func TestErrors(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.Authenticate = func(login string, passcode string) bool {
+		return login == "guest" && passcode == "guest"
+	}
+	l := frontendtest.Listen(t, server)
+
+	expectFrame(t, dial(t, l).do("CONNECT", "accept-version", "1.1"), "ERROR", "", "version", "1.2")
+	expectFrame(t, dial(t, l).connect("login", "guest", "passcode", "wrong"), "ERROR", "", "message", "access refused")
+
+	client := dial(t, l)
+	expectFrame(t, client.connect("login", "guest", "passcode", "guest"), "CONNECTED", "")
+	expectFrame(t, client.do("BEGIN", "transaction", "tx1", "receipt", "r1"), "ERROR", "", "receipt-id", "r1")
+	// the server closes the connection after an ERROR
+	if _, err := ReadFrame(client.Reader(), 0); err == nil {
+		t.Errorf("Expected the connection to be closed after the ERROR")
+	}
+}
+
+func TestHeartBeat(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	server.HeartBeat = time.Millisecond * 20
+	l := frontendtest.Listen(t, server)
+	client := dial(t, l)
+
+	expectFrame(t, client.connect("heart-beat", "100,20"), "CONNECTED", "", "heart-beat", "20,20")
+	if f, err := ReadFrame(client.Reader(), 0); err != nil || f.Command != "" {
+		t.Fatalf("Expected a heart-beat, got %v %v", f, err)
+	}
+	// the client promised heart-beats and sends none
+	for {
+		if _, err := ReadFrame(client.Reader(), 0); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Errorf("Expected the server to close the connection")
+			}
+			break
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	server := New(ps)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), "v10.stomp", "v12.stomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if ws.Subprotocol() != "v12.stomp" {
+		t.Errorf("Expected the v12.stomp subprotocol, got %q", ws.Subprotocol())
+	}
+	receive := func() Frame {
+		ws.SetReadDeadline(time.Now().Add(frontendtest.Timeout))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ReadFrame(bufio.NewReader(bytes.NewReader(data)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	send := func(f Frame) {
+		if err := ws.WriteMessage(websocket.TextMessage, AppendFrame(nil, f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(Frame{Command: "CONNECT", Headers: map[string]string{"accept-version": "1.2", "host": "localhost"}})
+	expectFrame(t, receive(), "CONNECTED", "", "version", "1.2")
+	send(Frame{Command: "SUBSCRIBE", Headers: map[string]string{"id": "sub-0", "destination": "/topic/chat", "receipt": "r1"}})
+	expectFrame(t, receive(), "RECEIPT", "", "receipt-id", "r1")
+	ps.Push("chat", "from a Go service")
+	expectFrame(t, receive(), "MESSAGE", "from a Go service", "subscription", "sub-0")
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	t.Parallel()
+	handshake := func(server *Server, origin string) int {
+		req := httptest.NewRequest("GET", "http://hub.example/stomp", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Protocol", "v12.stomp")
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	server := New(pubysuby.NewPubySuby())
+	defer server.Close()
+	if code := handshake(server, "http://evil.example"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a cross origin handshake, got %d", code)
+	}
+	server.CheckOrigin = func(r *http.Request) bool { return true }
+	// the recorder cannot be hijacked, so an accepted origin gets as far as a 500
+	if code := handshake(server, "http://evil.example"); code != http.StatusInternalServerError {
+		t.Errorf("Expected CheckOrigin to accept the origin, got %d", code)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	t.Parallel()
+	f := Frame{
+		Command: "MESSAGE",
+		Headers: map[string]string{"destination": "/topic/chat", "note": "a:b\nc\\d", "content-length": "5"},
+		Body:    []byte("x\x00y\r\n"),
+	}
+	encoded := AppendFrame(nil, f)
+	if !bytes.Contains(encoded, []byte(`note:a\cb\nc\\d`)) {
+		t.Errorf("Expected the header to be escaped, got %q", encoded)
+	}
+	// heart-beats around the frame
+	r := bufio.NewReader(bytes.NewReader(append(append([]byte("\r\n"), encoded...), '\n')))
+	if heartBeat, err := ReadFrame(r, 0); err != nil || heartBeat.Command != "" {
+		t.Errorf("Expected a heart-beat, got %v %v", heartBeat, err)
+	}
+	got, err := ReadFrame(r, 0)
+	if err != nil || !reflect.DeepEqual(got, f) {
+		t.Errorf("Expected %v, got %v %v", f, got, err)
+	}
+
+	cases := []struct {
+		frame string
+		err   error
+	}{
+		{"SEND\ndestination:a\\tb\n\nx\x00", ErrMalformed},
+		{"SEND\nno colon\n\nx\x00", ErrMalformed},
+		{"SEND\ncontent-length:1\n\nxy\x00", ErrMalformed},
+		{"SEND\ndestination:a\n\n" + strings.Repeat("x", 100) + "\x00", ErrFrameTooLarge},
+	}
+	for _, c := range cases {
+		if _, err := ReadFrame(bufio.NewReader(strings.NewReader(c.frame)), 64); err != c.err {
+			t.Errorf("Expected %v reading %q, got %v", c.err, c.frame, err)
+		}
+	}
+	// the headers of CONNECT are not escaped
+	connect, err := ReadFrame(bufio.NewReader(strings.NewReader("CONNECT\npasscode:a\\b\n\n\x00")), 0)
+	if err != nil || connect.Headers["passcode"] != `a\b` {
+		t.Errorf("Expected the CONNECT header as sent, got %v %v", connect.Headers, err)
+	}
+}
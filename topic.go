@@ -2,23 +2,67 @@ package pubysuby
 
 import (
 	"container/list"
-	//"log"
-	//"log"
-	//"strconv"
+	"errors"
+	"fmt"
 	"time"
 )
 
-type topicRequest struct {
-	Cmd                     string           // can be "sub" "subonce" "unsubscribe" "pub", "now"
-	subscriberListenChannel chan []TopicItem // filled in during "sub", "unsubscribe", "now"
-	content                 string           // message during "pub"
-	since                   int64            // messageId during "pullsince"
-}
+// how often a topic controller garbage collects its messages
+const gcInterval = time.Second
+
+// how long a topic remembers the idempotency keys of published messages unless configured otherwise
+const defaultDedupWindow = time.Minute * 2
 
 type TopicItem struct {
-	MessageId   int64
+	MessageId int64
+	// Generation of the topic's message id sequence the MessageId belongs to
+	Generation  int64
 	Message     string
 	CreatedTime time.Time
+	// ExpiresAt overrides the topic's max age when set
+	ExpiresAt time.Time
+	// Key identifies the state the message updates in a compacted topic
+	Key string
+	// Tombstone marks the deletion of the Key
+	Tombstone bool
+	// Headers carry metadata that filters can match on without decoding the payload
+	Headers map[string]string
+	// Priority orders pending messages, higher first
+	Priority int
+	// MsgId is the publisher's idempotency key
+	MsgId string
+	// Retained marks the topic's retained message when Sub or Pull return it
+	Retained bool
+}
+
+type listener struct {
+	subOnce bool
+	filters []Filter
+	// buffers the messages of a "sub" listener, nil for "pull*" listeners
+	queue *subscriberQueue
+}
+
+// deliver hands the item to the listener
+func (l listener) deliver(ch chan []TopicItem, item TopicItem) {
+	if l.queue != nil {
+		l.queue.in <- item
+	} else {
+		ch <- []TopicItem{item}
+	}
+}
+
+// stop closes the listener's channel, what is still queued for it is dropped after a grace period
+func (l listener) stop(ch chan []TopicItem) {
+	if l.queue != nil {
+		close(l.queue.stop)
+	} else {
+		close(ch)
+	}
+}
+
+// size is the number of bytes the item counts against the retention limits
+func (item TopicItem) size() int {
+	return len(item.Message) + len(item.Key)
 }
 
 type Topic struct {
@@ -26,19 +70,71 @@ type Topic struct {
 	globalTimeOut  int64
 	item_max_age   int
 	maxItemsLength int
-	CommandChannel chan topicRequest
+	CommandChannel chan topicCommand
 	messages       *list.List
+	// key: listener channels that can receive a string
+	// value: pub once and the filters of the listener
+	// pub once is needed because "pull*" command has a listener
+	// that will disappear after it receives the data
+	// unlike the "sub"
+	pubOnceListeners map[chan []TopicItem]listener
+	// a transaction holds the topic, the items it publishes are delivered when it lets go
+	locked        bool
+	held          []TopicItem
+	lastMessageId int64
+	// changes whenever the message id sequence starts over, see IdScheme
+	generation    int64
+	clock         *hybridClock // hub-wide clock of ClockIds, nil for SequenceIds
+	sequenceStore SequenceStore
+	reserved      int64 // highest id reserved in the sequenceStore
+	// highest message id removed by the retention limits, a cursor before it has missed messages
+	trimmedUpTo int64
+	maxBytes    int // 0 means no byte limit
+	bytes       int // payload bytes of the retained messages
+	budget      *memoryBudget
+	compacted   bool
+	// key: message key
+	// value: element holding the latest message for the key,
+	// only maintained for compacted topics
+	latest map[string]*list.Element
+	// last message published with retain, outlives the retention limits
+	retainedItem *TopicItem
+	dedupWindow  time.Duration
+	// key: idempotency key of a published message
+	// value: the message id it got and when it was published
+	published map[string]publishedMsgId
+}
+
+type publishedMsgId struct {
+	messageId int64
+	at        time.Time
 }
 
 func NewTopic(topicName string) *Topic {
-	ch := make(chan topicRequest)
+	return newTopic(topicName, Options{}, nil, nil)
+}
+
+// newTopic creates a topic bound by the options that reports its retained bytes to the hub budget,
+// the clock is only used with ClockIds
+func newTopic(topicName string, options Options, budget *memoryBudget, clock *hybridClock) *Topic {
+	ch := make(chan topicCommand)
 	t := Topic{
-		CommandChannel: ch,
-		globalTimeOut:  30,
-		topicName:      topicName,
-		item_max_age:   1,
-		maxItemsLength: 100,
-		messages:       list.New(),
+		CommandChannel:   ch,
+		globalTimeOut:    30,
+		topicName:        topicName,
+		item_max_age:     1,
+		maxItemsLength:   100,
+		messages:         list.New(),
+		pubOnceListeners: make(map[chan []TopicItem]listener),
+		maxBytes:         options.MaxTopicBytes,
+		dedupWindow:      defaultDedupWindow,
+		published:        make(map[string]publishedMsgId),
+		budget:           budget,
+		latest:           make(map[string]*list.Element),
+		sequenceStore:    options.SequenceStore,
+	}
+	if options.IdScheme == ClockIds {
+		t.clock = clock
 	}
 	go t.topicController()
 	return &t
@@ -46,130 +142,367 @@ func NewTopic(topicName string) *Topic {
 
 func (t *Topic) topicController() {
 	//fmt.Println("Started topic controller", topicName)
-	// key: listener channels that can receive a string
-	// value: pub once
-	// this is needed because "pull*" command has a listener
-	// that will disappear after it receives the data
-	// unlike the "sub"
-	pubOnceListeners := make(map[chan []TopicItem]bool)
-	var lastMessageId int64 = 1
-
+	t.startSequence()
+	// a ticker keeps firing no matter how busy the command channel is,
+	// unlike a time.After recreated on every loop iteration
+	gcTicker := time.NewTicker(gcInterval)
+	defer gcTicker.Stop()
 	for {
 		select {
-		case <-time.After(time.Second * 1):
+		case <-gcTicker.C:
 			t.GC()
 		case cmd := <-t.CommandChannel:
-			if cmd.Cmd == "sub" {
-
-				//log.Println("Subscribed")
-				pubOnceListeners[cmd.subscriberListenChannel] = false
+			t.handle(cmd)
+		} // end of select
+	} // end of for
+}
 
-			} else if cmd.Cmd == "pull" {
+func (t *Topic) handle(cmd topicCommand) {
+	switch cmd := cmd.(type) {
+	case subCommand:
+		t.sub(cmd)
+	case pullCommand:
+		t.pull(cmd)
+	case unsubscribeCommand:
+		t.unsubscribe(cmd)
+	case pubCommand:
+		t.pub(cmd)
+	case lastMessageIdCommand:
+		cmd.replyChannel <- lastMessageIdReply{messageId: t.lastMessageId}
+	case statsCommand:
+		cmd.replyChannel <- statsReply{stats: t.stats()}
+	case historyCommand:
+		cmd.replyChannel <- historyReply{page: t.history(cmd.query)}
+	case evictCommand:
+		cmd.replyChannel <- t.evict(cmd)
+	case configureCommand:
+		t.configure(cmd.options)
+		close(cmd.done)
+	case lockCommand:
+		// only the lock holder's commands are handled until it closes its channel
+		close(cmd.locked)
+		t.locked = true
+		for held := range cmd.holderChannel {
+			t.handle(held)
+		}
+		t.locked = false
+		for _, item := range t.held {
+			t.notify(item)
+		}
+		t.held = nil
+	default:
+		cmd.reject(fmt.Errorf("%w: %T", ErrUnknownCommand, cmd))
+	}
+}
 
-				//log.Println("Started pull")
-				pubOnceListeners[cmd.subscriberListenChannel] = true
-				if t.messages.Len() > 0 {
+func (t *Topic) sub(cmd subCommand) {
+	//log.Println("Subscribed")
+	l := listener{filters: cmd.filters, queue: newSubscriberQueue(cmd.listenChannel)}
+	t.pubOnceListeners[cmd.listenChannel] = l
+	if t.retainedItem != nil && MatchAll(cmd.filters, *t.retainedItem) {
+		// the subscriber queue buffers it, so this does not wait for the subscriber to start receiving
+		l.deliver(cmd.listenChannel, *t.retainedItem)
+	}
+}
 
-					results := make([]TopicItem, 0, t.messages.Len())
-					for e := t.messages.Front(); e != nil; e = e.Next() {
-						var item TopicItem
-						item = e.Value.(TopicItem)
-						results = append(results, item)
-					}
-					delete(pubOnceListeners, cmd.subscriberListenChannel)
-					cmd.subscriberListenChannel <- results
-					//log.Println("Closed pull")
-					// close it so that pull receive stops
+func (t *Topic) pull(cmd pullCommand) {
+	//log.Println("Started pull since: ", cmd.since)
+	if cmd.cursor != nil {
+		err := checkCursor(*cmd.cursor, t.stats(), t.clock != nil)
+		cmd.cursorReply <- err
+		if err != nil && !errors.Is(err, ErrCursorTrimmed) {
+			close(cmd.listenChannel)
+			return
+		}
+	}
+	t.pubOnceListeners[cmd.listenChannel] = listener{subOnce: true, filters: cmd.filters}
+	// check if there is any data to send on the initial pull
+	// the retained message is sent even if it was trimmed from the que
+	retained := t.retainedItem
+	if retained != nil && (retained.MessageId <= cmd.since || !MatchAll(cmd.filters, *retained)) {
+		retained = nil
+	}
+	if t.messages.Len() > 0 || retained != nil {
+		now := time.Now()
+		results := make([]TopicItem, 0, t.messages.Len()+1)
+		for e := t.messages.Front(); e != nil; e = e.Next() {
+			item := e.Value.(TopicItem)
+			if retained != nil && item.MessageId >= retained.MessageId {
+				// keep the results ordered by message id
+				results = append(results, *retained)
+				retained = nil
+				if item.MessageId == results[len(results)-1].MessageId {
+					continue
+				}
+			}
+			// expired items may still be waiting for the next GC
+			if item.MessageId > cmd.since && !t.expired(e, now) && MatchAll(cmd.filters, item) {
+				results = append(results, item)
+			}
+		}
+		if retained != nil {
+			results = append(results, *retained)
+		}
+		if len(results) > 0 {
+			if cmd.byPriority {
+				sortByPriority(results)
+			}
+			delete(t.pubOnceListeners, cmd.listenChannel)
+			cmd.listenChannel <- results
+			//log.Println("Closed pull")
+			// close it so that pull receive stops
+			close(cmd.listenChannel)
+		}
+	}
+}
 
-					close(cmd.subscriberListenChannel)
+func (t *Topic) unsubscribe(cmd unsubscribeCommand) {
+	l, present := t.pubOnceListeners[cmd.listenChannel]
+	if present {
+		//log.Println("unsubscribed")
+		delete(t.pubOnceListeners, cmd.listenChannel)
+		// TODO: Does this really notify the subscriber that no more data is coming?
+		l.stop(cmd.listenChannel)
+	}
+}
 
-				}
+func (t *Topic) pub(cmd pubCommand) {
+	if cmd.msgId != "" {
+		if original, ok := t.published[cmd.msgId]; ok && time.Since(original.at) < t.dedupWindow {
+			// a retry of a message that was already published
+			cmd.replyChannel <- pubReply{messageId: original.messageId}
+			return
+		}
+	}
+	if cmd.ifLast && cmd.expectedLastId != t.lastMessageId {
+		cmd.replyChannel <- pubReply{
+			err: fmt.Errorf("%w: expected last message id %d, topic is at %d", ErrConflict, cmd.expectedLastId, t.lastMessageId),
+		}
+		return
+	}
+	item := TopicItem{
+		MessageId:   t.nextId(),
+		Generation:  t.generation,
+		Message:     cmd.content,
+		CreatedTime: time.Now(),
+		Key:         cmd.key,
+		Tombstone:   cmd.tombstone,
+		Headers:     cmd.headers,
+		Priority:    cmd.priority,
+		MsgId:       cmd.msgId,
+	}
+	if cmd.msgId != "" {
+		t.published[cmd.msgId] = publishedMsgId{messageId: item.MessageId, at: item.CreatedTime}
+	}
+	if cmd.ttl > 0 {
+		item.ExpiresAt = item.CreatedTime.Add(cmd.ttl)
+	}
+	t.append(item)
+	if cmd.retain {
+		// like MQTT, publishing an empty retained message clears the retained message
+		t.retainedItem = nil
+		if item.Message != "" {
+			retained := item
+			retained.Retained = true
+			t.retainedItem = &retained
+		}
+	}
+	// enforce the size limit on publish so a busy topic stays bounded between GC ticks
+	t.trimToSize()
 
-			} else if cmd.Cmd == "pullsince" {
-
-				//log.Println("Started pullsince: ", cmd.since)
-
-				pubOnceListeners[cmd.subscriberListenChannel] = true
-				// check if there is any data to send on the initial subscription
-				if t.messages.Len() > 0 {
-					results := make([]TopicItem, 0, t.messages.Len())
-					for e := t.messages.Front(); e != nil; e = e.Next() {
-						var item TopicItem
-						item = e.Value.(TopicItem)
-
-						if item.MessageId > cmd.since {
-							results = append(results, item)
-						}
-					}
-					if len(results) > 0 {
-
-						delete(pubOnceListeners, cmd.subscriberListenChannel)
-						cmd.subscriberListenChannel <- results
-						//log.Println("Closed pull since")
-						// TODO: Does this really notify the subscriber that no more data is coming?
-						close(cmd.subscriberListenChannel)
-					}
-				}
-			} else if cmd.Cmd == "unsubscribe" {
-				_, present := pubOnceListeners[cmd.subscriberListenChannel]
-				if present {
-					//log.Println("unsubscribed")
-					delete(pubOnceListeners, cmd.subscriberListenChannel)
-					// TODO: Does this really notify the subscriber that no more data is coming?
-					close(cmd.subscriberListenChannel)
-				}
+	cmd.replyChannel <- pubReply{messageId: item.MessageId}
 
-			} else if cmd.Cmd == "pub" {
+	//fmt.Println("Publish", cmd.content)
+	if t.locked {
+		// a transaction's messages reach the listeners once every topic of the transaction has them
+		t.held = append(t.held, item)
+		return
+	}
+	t.notify(item)
+}
 
-				lastMessageId++
-				item := TopicItem{MessageId: lastMessageId, Message: cmd.content, CreatedTime: time.Now()}
-				t.messages.PushBack(item)
+// notify delivers the published item to the listeners it passes the filters of
+func (t *Topic) notify(item TopicItem) {
+	for ch, l := range t.pubOnceListeners {
+		if !MatchAll(l.filters, item) {
+			continue
+		}
+		l.deliver(ch, item)
+		if l.subOnce {
+			delete(t.pubOnceListeners, ch)
+			l.stop(ch)
+		}
+	}
+}
 
-				cmd.subscriberListenChannel <- []TopicItem{item}
+func (t *Topic) stats() TopicStats {
+	stats := TopicStats{
+		TopicName:     t.topicName,
+		Messages:      t.messages.Len(),
+		LastMessageId: t.lastMessageId,
+		Generation:    t.generation,
+		Bytes:         t.bytes,
+		TrimmedUpTo:   t.trimmedUpTo,
+	}
+	if front := t.messages.Front(); front != nil {
+		stats.OldestCreatedTime = front.Value.(TopicItem).CreatedTime
+		stats.FirstMessageId = front.Value.(TopicItem).MessageId
+	}
+	for _, l := range t.pubOnceListeners {
+		if l.subOnce {
+			stats.Pullers++
+		} else {
+			stats.Subscribers++
+		}
+	}
+	return stats
+}
 
-				//fmt.Println("Publish", cmd.content)
-				for ch, subOnce := range pubOnceListeners {
-					ch <- []TopicItem{item}
-					if subOnce {
-						delete(pubOnceListeners, ch)
-						close(ch)
-					}
-				}
-			} else if cmd.Cmd == "lastMessageId" {
-				cmd.subscriberListenChannel <- []TopicItem{{MessageId: lastMessageId}}
-				close(cmd.subscriberListenChannel)
+func (t *Topic) configure(options TopicOptions) {
+	if t.compacted && !options.Compacted {
+		t.latest = make(map[string]*list.Element)
+	} else if !t.compacted && options.Compacted {
+		for e := t.messages.Front(); e != nil; e = e.Next() {
+			if key := e.Value.(TopicItem).Key; key != "" {
+				t.latest[key] = e
 			}
-		} // end of select
-	} // end of for
+		}
+	}
+	t.compacted = options.Compacted
+	t.dedupWindow = options.DedupWindow
+	if t.dedupWindow == 0 {
+		t.dedupWindow = defaultDedupWindow
+	}
 }
 
+// GC trims the messages that have expired or are over maxItemsLength,
+// and in a compacted topic the messages superseded by a newer one with the same key
 func (t *Topic) GC() {
-	// TODO: If the topic is too busy, GC based on <-timeafter will not kick in
+	t.forgetMsgIds()
 	messagesCount := t.messages.Len()
 	if messagesCount > 0 {
 		//log.Println("GC due to messages Count: " + strconv.Itoa(messagesCount))
+		if t.compacted {
+			t.compact()
+		}
 		t.trimToMaxAge()
 		t.trimToSize()
 	}
 
 }
 
+// forgetMsgIds drops the idempotency keys that are older than the dedup window
+func (t *Topic) forgetMsgIds() {
+	for msgId, original := range t.published {
+		if time.Since(original.at) >= t.dedupWindow {
+			delete(t.published, msgId)
+		}
+	}
+}
+
+// compact keeps only the latest message per key
+func (t *Topic) compact() {
+	var next *list.Element
+	for e := t.messages.Front(); e != nil; e = next {
+		next = e.Next()
+		item := e.Value.(TopicItem)
+		if item.Key != "" && t.latest[item.Key] != e {
+			// a newer message carries the key's state, so nothing is lost
+			t.discard(e)
+		}
+	}
+}
+
+// retained reports whether the element holds the current value of a key in a compacted topic,
+// such elements survive the max age and item count limits
+func (t *Topic) retained(e *list.Element) bool {
+	item := e.Value.(TopicItem)
+	return t.compacted && item.Key != "" && !item.Tombstone && item.ExpiresAt.IsZero() && t.latest[item.Key] == e
+}
+
 func (t *Topic) trimToSize() {
 	messagesCount := t.messages.Len()
 	if messagesCount > t.maxItemsLength {
 		diff := messagesCount - t.maxItemsLength
-		for i := 0; i < diff; i++ {
-			t.messages.Remove(t.messages.Front()) // Remove the first item from the que
+		var next *list.Element
+		for e := t.messages.Front(); e != nil && diff > 0; e = next {
+			next = e.Next()
+			if !t.retained(e) {
+				t.remove(e) // Remove the oldest item from the que
+				diff--
+			}
+		}
+	}
+	// the byte limit bounds memory, so it applies to the retained messages as well
+	for t.maxBytes > 0 && t.bytes > t.maxBytes {
+		t.remove(t.messages.Front())
+	}
+}
+
+// evict removes the oldest messages as asked by the hub's eviction controller
+func (t *Topic) evict(cmd evictCommand) int {
+	var freed int64
+	removed := 0
+	for e := t.messages.Front(); e != nil && freed < cmd.bytes; e = t.messages.Front() {
+		item := e.Value.(TopicItem)
+		if removed > 0 && !cmd.createdBefore.IsZero() && item.CreatedTime.After(cmd.createdBefore) {
+			break
 		}
+		freed += int64(item.size())
+		t.remove(e)
+		removed++
 	}
+	return removed
+}
+
+// append adds the item to the end of the que and accounts for its bytes
+func (t *Topic) append(item TopicItem) {
+	e := t.messages.PushBack(item)
+	if t.compacted && item.Key != "" {
+		t.latest[item.Key] = e
+	}
+	t.bytes += item.size()
+	t.budget.add(item.size())
+}
+
+// remove trims the element from the que, pullers that did not get it yet have missed it
+func (t *Topic) remove(e *list.Element) {
+	if id := e.Value.(TopicItem).MessageId; id > t.trimmedUpTo {
+		t.trimmedUpTo = id
+	}
+	t.discard(e)
+}
+
+// discard takes the element out of the que and releases its bytes
+func (t *Topic) discard(e *list.Element) {
+	item := t.messages.Remove(e).(TopicItem)
+	if t.latest[item.Key] == e {
+		delete(t.latest, item.Key)
+	}
+	t.bytes -= item.size()
+	t.budget.add(-item.size())
 }
 
 func (t *Topic) trimToMaxAge() {
-	for e := t.messages.Front(); e != nil; e = e.Next() {
-		var item TopicItem
-		item = e.Value.(TopicItem)
-		if int(time.Since(item.CreatedTime).Seconds()) > t.item_max_age {
-			t.messages.Remove(e)
+	// Remove clears e.Next(), so the next element has to be fetched before removing
+	var next *list.Element
+	now := time.Now()
+	for e := t.messages.Front(); e != nil; e = next {
+		next = e.Next()
+		if t.expired(e, now) {
+			t.remove(e)
 		}
 	}
 }
+
+// expired reports whether the item outlived its own expiry, or item_max_age when it has none
+func (t *Topic) expired(e *list.Element, now time.Time) bool {
+	if t.retained(e) {
+		return false
+	}
+	item := e.Value.(TopicItem)
+	if !item.ExpiresAt.IsZero() {
+		return !now.Before(item.ExpiresAt)
+	}
+	return int(now.Sub(item.CreatedTime).Seconds()) > t.item_max_age
+}
@@ -0,0 +1,85 @@
+package pubysuby
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrTxDone is returned when a transaction is used after Commit or Rollback
+var ErrTxDone = errors.New("pubysuby: transaction already committed or rolled back")
+
+// Tx collects messages for several topics and publishes them together
+type Tx struct {
+	ps       *PubySuby
+	messages []txMessage
+	done     bool
+}
+
+type txMessage struct {
+	topic   string
+	message string
+}
+
+// Tx starts a transaction
+func (ps *PubySuby) Tx() *Tx {
+	return &Tx{ps: ps}
+}
+
+// Push adds the message for the topic to the transaction, it is not visible until Commit
+func (tx *Tx) Push(topic string, message string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.messages = append(tx.messages, txMessage{topic: topic, message: message})
+	return nil
+}
+
+// Commit publishes the messages of the transaction and returns their message ids in the order they were pushed.
+// Every topic of the transaction is locked before the first message is appended and unlocked after the last one,
+// and a topic delivers the messages to its subscribers and waiting pullers only when it is unlocked,
+// so whoever sees one of the messages can already find the others in their topics.
+// While a topic is locked it handles nothing else, its GC and eviction wait until the Commit returns.
+func (tx *Tx) Commit() ([]int64, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	tx.done = true
+
+	holders := make(map[string]chan topicCommand)
+	var names []string
+	for _, m := range tx.messages {
+		if _, ok := holders[m.topic]; !ok {
+			holders[m.topic] = nil
+			names = append(names, m.topic)
+		}
+	}
+	// lock in name order so concurrent transactions cannot deadlock
+	sort.Strings(names)
+	for _, name := range names {
+		holderChannel := make(chan topicCommand)
+		locked := make(chan struct{})
+		tx.ps.getTopicRequestChannel(name) <- lockCommand{holderChannel: holderChannel, locked: locked}
+		<-locked
+		holders[name] = holderChannel
+	}
+
+	messageIds := make([]int64, 0, len(tx.messages))
+	for _, m := range tx.messages {
+		holder := TopicHandle{topicName: m.topic, commandChannel: holders[m.topic]}
+		messageIds = append(messageIds, holder.Push(m.message))
+	}
+	for _, holderChannel := range holders {
+		close(holderChannel)
+	}
+	return messageIds, nil
+}
+
+// Rollback discards the messages of the transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.messages = nil
+	return nil
+}
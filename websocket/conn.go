@@ -0,0 +1,438 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcodes of the frames, RFC 6455 section 5.2
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// Close codes, RFC 6455 section 7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupported     = 1003
+	CloseNoStatus        = 1005
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+)
+
+// the key every Sec-WebSocket-Accept is derived from
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// how large a message Upgrade accepts unless the Conn says otherwise
+const defaultMaxMessageSize = 1 << 20
+
+// ErrClosed is returned when writing after the close frame was sent
+var ErrClosed = errors.New("websocket: connection closed")
+
+// CloseError is returned by ReadMessage when the peer sent a close frame
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with code %d %s", e.Code, e.Reason)
+}
+
+// Conn is one end of a WebSocket connection.
+// One goroutine may read while others write, writes are serialized.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// client connections mask the frames they send
+	client      bool
+	subprotocol string
+	// MaxMessageSize is the largest message ReadMessage accepts, 0 means no limit
+	MaxMessageSize int64
+
+	mu        sync.Mutex
+	closeSent bool
+}
+
+// Upgrader answers WebSocket handshakes
+type Upgrader struct {
+	// CheckOrigin reports whether a handshake from the request's Origin is accepted,
+	// nil accepts only SameOrigin requests so other sites cannot open connections with the user's cookies
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Upgrade answers the WebSocket handshake of a same origin request, see Upgrader.Upgrade
+func Upgrade(w http.ResponseWriter, r *http.Request, protocols ...string) (*Conn, error) {
+	return (&Upgrader{}).Upgrade(w, r, protocols...)
+}
+
+// SameOrigin reports whether the request has no Origin header, as non browser clients send,
+// or an Origin whose host is the request's Host
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Upgrade answers the WebSocket handshake of the request and takes over its connection.
+// The first of the protocols the client offers in Sec-WebSocket-Protocol is selected.
+// On failure an HTTP error has already been written.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, protocols ...string) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "websocket: the handshake must be a GET", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: the handshake must be a GET")
+	}
+	if !hasToken(r.Header, "Connection", "upgrade") || !hasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket: not a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket: unsupported version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "websocket: origin not allowed", http.StatusForbidden)
+		return nil, errors.New("websocket: origin not allowed")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "websocket: missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing Sec-WebSocket-Key")
+	}
+	subprotocol := selectProtocol(r.Header, protocols)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket: the connection cannot be hijacked", http.StatusInternalServerError)
+		return nil, errors.New("websocket: the connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if subprotocol != "" {
+		response += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	if _, err := rw.WriteString(response + "\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, br: rw.Reader, subprotocol: subprotocol, MaxMessageSize: defaultMaxMessageSize}, nil
+}
+
+// Dial opens a client connection to a ws:// or wss:// URL, offering the protocols
+func Dial(rawurl string, protocols ...string) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = net.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.Dial("tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := "GET " + u.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n"
+	if len(protocols) > 0 {
+		request += "Sec-WebSocket-Protocol: " + strings.Join(protocols, ", ") + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket: handshake failed with status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, errors.New("websocket: handshake failed with a bad Sec-WebSocket-Accept")
+	}
+	return &Conn{conn: conn, br: br, client: true, subprotocol: resp.Header.Get("Sec-WebSocket-Protocol")}, nil
+}
+
+// Subprotocol is the protocol selected during the handshake, empty when none was
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// ReadMessage returns the next text or binary message.
+// Pings are answered while reading, a close frame is answered and returned as a *CloseError.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOpcode {
+		case PingMessage:
+			if err := c.WriteMessage(PongMessage, payload); err != nil && err != ErrClosed {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			// echo the close, unless this end started the closing handshake
+			echo := closeErr.Code
+			if echo == CloseNoStatus {
+				echo = CloseNormal
+			}
+			c.WriteClose(echo, "")
+			return 0, nil, closeErr
+		case TextMessage, BinaryMessage:
+			if message != nil {
+				return 0, nil, c.fail(CloseProtocolError, "expected a continuation frame")
+			}
+			opcode = frameOpcode
+			message = payload
+		case continuationFrame:
+			if message == nil {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+			message = append(message, payload...)
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", frameOpcode))
+		}
+		if c.MaxMessageSize > 0 && int64(len(message)) > c.MaxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame and unmasks its payload
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	masked := header[1]&0x80 != 0
+	if masked == c.client {
+		return false, 0, nil, c.fail(CloseProtocolError, "bad masking")
+	}
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.br, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.br, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(extended[:]))
+	}
+	if opcode >= CloseMessage && (!fin || length > 125) {
+		return false, 0, nil, c.fail(CloseProtocolError, "bad control frame")
+	}
+	if length < 0 || (c.MaxMessageSize > 0 && length > c.MaxMessageSize) {
+		return false, 0, nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends the data as a single frame
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, len(data)+14)
+	frame = append(frame, 0x80|byte(opcode))
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(data) < 126:
+		frame = append(frame, maskBit|byte(len(data)))
+	case len(data) <= 0xffff:
+		frame = append(frame, maskBit|126, byte(len(data)>>8), byte(len(data)))
+	default:
+		frame = append(frame, maskBit|127)
+		var extended [8]byte
+		binary.BigEndian.PutUint64(extended[:], uint64(len(data)))
+		frame = append(frame, extended[:]...)
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, data...)
+		maskBytes(mask, frame[start:])
+	} else {
+		frame = append(frame, data...)
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// WriteClose starts the closing handshake, or answers the peer's close frame
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return c.WriteMessage(CloseMessage, append(payload, reason...))
+}
+
+// SetReadDeadline sets the deadline for ReadMessage
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Close closes the underlying connection without a closing handshake
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// fail sends a close frame for a protocol error and returns the error
+func (c *Conn) fail(code int, reason string) error {
+	c.WriteClose(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func maskBytes(mask [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hasToken reports whether the comma separated header contains the token, ignoring case
+func hasToken(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func selectProtocol(header http.Header, protocols []string) string {
+	for _, value := range header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		for _, offered := range strings.Split(value, ",") {
+			offered = strings.TrimSpace(offered)
+			for _, protocol := range protocols {
+				if offered == protocol {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,263 @@
+// Package websocket serves a PubySuby hub to browsers over WebSocket.
+//
+// A single connection multiplexes any number of topics with a small JSON protocol,
+// every request may carry a ref that is echoed in its reply:
+//
+//	{"op":"subscribe","ref":"1","topic":"chat","since":41,"filter":"region == \"eu\""}
+//	{"op":"unsubscribe","ref":"2","topic":"chat"}
+//	{"op":"publish","ref":"3","topic":"chat","message":"hi","headers":{"region":"eu"}}
+//	{"op":"ack","seq":7}
+//	{"op":"ping","ref":"4"}
+//
+// The server answers with "ok", "error" and "pong" events and delivers the messages as
+//
+//	{"op":"message","topic":"chat","seq":8,"message":{"id":42,"message":"hi",...}}
+//
+// seq numbers the deliveries of the connection. Unless the Gateway's Window is 0 the server stops
+// delivering once Window messages are unacknowledged, an ack acknowledges every delivery up to its seq.
+// Deliveries that cannot be sent wait in a queue of SendQueue messages,
+// a client that lets the queue overflow is disconnected with close code 1008.
+//
+// The package also holds the small RFC 6455 implementation the gateway runs on, see Conn.
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/httpapi"
+	"github.com/rambocoder/pubysuby/internal/frontend"
+)
+
+// how many deliveries may be unacknowledged unless the Gateway says otherwise
+const defaultWindow = 64
+
+// how many deliveries may wait to be sent unless the Gateway says otherwise
+const defaultSendQueue = 256
+
+// Request is a message from the client
+type Request struct {
+	Op  string `json:"op"`
+	Ref string `json:"ref,omitempty"`
+	// Topic of subscribe, unsubscribe and publish
+	Topic string `json:"topic,omitempty"`
+	// Since replays the retained messages after the message id when subscribing
+	Since int64 `json:"since,omitempty"`
+	// Filter is a filter expression for subscribe, see pubysuby.ParseFilter
+	Filter   string            `json:"filter,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Key      string            `json:"key,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+	MsgId    string            `json:"msg_id,omitempty"`
+	// Seq of ack
+	Seq int64 `json:"seq,omitempty"`
+}
+
+// Event is a message from the server
+type Event struct {
+	Op    string `json:"op"`
+	Ref   string `json:"ref,omitempty"`
+	Topic string `json:"topic,omitempty"`
+	// Seq numbers the "message" events of the connection
+	Seq int64 `json:"seq,omitempty"`
+	// Id of the message a publish created
+	Id      int64            `json:"id,omitempty"`
+	Message *httpapi.Message `json:"message,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// Gateway serves the JSON protocol on the WebSocket connections it upgrades
+type Gateway struct {
+	ps *pubysuby.PubySuby
+	// Window is how many deliveries may be unacknowledged, 0 turns acknowledgements off
+	Window int
+	// SendQueue is how many deliveries may wait to be sent before the client is disconnected
+	SendQueue int
+	// CheckOrigin reports whether a handshake from the request's Origin is accepted, nil accepts SameOrigin only
+	CheckOrigin func(r *http.Request) bool
+}
+
+// New creates a Gateway for the hub
+func New(ps *pubysuby.PubySuby) *Gateway {
+	return &Gateway{ps: ps, Window: defaultWindow, SendQueue: defaultSendQueue}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&Upgrader{CheckOrigin: g.CheckOrigin}).Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	s := &session{
+		gateway:       g,
+		conn:          conn,
+		front:         frontend.NewConn(conn, g.SendQueue),
+		acks:          make(chan int64),
+		subscriptions: make(map[string]*frontend.Subscription),
+	}
+	s.front.SlowConsumer = func() { s.close(ClosePolicyViolation, "slow consumer") }
+	go s.writeDeliveries()
+	s.readRequests()
+}
+
+// session is the state of one connection.
+// The reading goroutine owns the subscriptions and answers the requests,
+// the writing goroutine sends the deliveries within the window.
+type session struct {
+	gateway *Gateway
+	conn    *Conn
+	// queues the "message" events
+	front         *frontend.Conn
+	acks          chan int64
+	subscriptions map[string]*frontend.Subscription
+}
+
+// readRequests handles the client's requests until the connection closes,
+// then it ends every subscription
+func (s *session) readRequests() {
+	defer func() {
+		s.close(CloseNormal, "")
+		for _, sub := range s.subscriptions {
+			sub.Unsubscribe()
+		}
+	}()
+	for {
+		opcode, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if opcode != TextMessage {
+			s.reply(Event{Op: "error", Error: "expected a text message"})
+			continue
+		}
+		var request Request
+		if err := json.Unmarshal(data, &request); err != nil {
+			s.reply(Event{Op: "error", Error: fmt.Sprintf("bad request: %v", err)})
+			continue
+		}
+		if err := s.handle(request); err != nil {
+			s.reply(Event{Op: "error", Ref: request.Ref, Topic: request.Topic, Error: err.Error()})
+		}
+	}
+}
+
+func (s *session) handle(request Request) error {
+	switch request.Op {
+	case "subscribe":
+		if _, ok := s.subscriptions[request.Topic]; ok {
+			return fmt.Errorf("already subscribed to %q", request.Topic)
+		}
+		var filters []pubysuby.Filter
+		if request.Filter != "" {
+			filter, err := pubysuby.ParseFilter(request.Filter)
+			if err != nil {
+				return err
+			}
+			filters = append(filters, filter)
+		}
+		sub := frontend.Subscribe(s.gateway.ps.Topic(request.Topic), filters...)
+		s.subscriptions[request.Topic] = sub
+		// answer before the first delivery
+		s.reply(Event{Op: "ok", Ref: request.Ref, Topic: request.Topic})
+		go s.forward(sub, request.Since, filters)
+	case "unsubscribe":
+		sub, ok := s.subscriptions[request.Topic]
+		if !ok {
+			return fmt.Errorf("not subscribed to %q", request.Topic)
+		}
+		delete(s.subscriptions, request.Topic)
+		sub.Unsubscribe()
+		s.reply(Event{Op: "ok", Ref: request.Ref, Topic: request.Topic})
+	case "publish":
+		id, err := s.gateway.ps.Topic(request.Topic).PushWithOptions(request.Message, pubysuby.PushOptions{
+			Key:      request.Key,
+			Headers:  request.Headers,
+			Priority: request.Priority,
+			MsgId:    request.MsgId,
+		})
+		if err != nil {
+			return err
+		}
+		s.reply(Event{Op: "ok", Ref: request.Ref, Topic: request.Topic, Id: id})
+	case "ack":
+		select {
+		case s.acks <- request.Seq:
+		case <-s.front.Done():
+		}
+	case "ping":
+		s.reply(Event{Op: "pong", Ref: request.Ref})
+	default:
+		return fmt.Errorf("unknown op %q", request.Op)
+	}
+	return nil
+}
+
+// forward queues the subscription's messages for delivery, first the retained messages after since
+func (s *session) forward(sub *frontend.Subscription, since int64, filters []pubysuby.Filter) {
+	var replay frontend.Replay
+	if since > 0 {
+		replay = frontend.Replay{From: since + 1, Match: func(item pubysuby.TopicItem) bool {
+			return pubysuby.MatchAll(filters, item)
+		}}
+	}
+	sub.Forward(replay, func(item pubysuby.TopicItem) {
+		message := httpapi.ToMessage(item)
+		s.front.Deliver(Event{Op: "message", Topic: sub.Topic.Name(), Message: &message})
+	})
+}
+
+// writeDeliveries sends the queued deliveries while fewer than Window are unacknowledged
+func (s *session) writeDeliveries() {
+	var sent, acked int64
+	window := int64(s.gateway.Window)
+	for {
+		deliveries := s.front.Deliveries
+		if window > 0 && sent-acked >= window {
+			deliveries = nil
+		}
+		select {
+		case <-s.front.Done():
+			return
+		case seq := <-s.acks:
+			if seq > sent {
+				seq = sent
+			}
+			if seq > acked {
+				acked = seq
+			}
+		case delivery := <-deliveries:
+			event := delivery.(Event)
+			sent++
+			event.Seq = sent
+			if err := s.write(event); err != nil {
+				s.close(CloseGoingAway, "")
+				return
+			}
+		}
+	}
+}
+
+// reply sends an answer to a request, answers are not held back by the window
+func (s *session) reply(event Event) {
+	if err := s.write(event); err != nil && !errors.Is(err, ErrClosed) {
+		s.close(CloseGoingAway, "")
+	}
+}
+
+func (s *session) write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(TextMessage, data)
+}
+
+// close ends the session, the reading goroutine then unsubscribes everything
+func (s *session) close(code int, reason string) {
+	s.front.CloseWith(func() {
+		s.conn.WriteClose(code, reason)
+	})
+}
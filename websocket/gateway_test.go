@@ -0,0 +1,196 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rambocoder/pubysuby"
+	"github.com/rambocoder/pubysuby/internal/frontend/frontendtest"
+)
+
+func dial(t *testing.T, gateway *Gateway) (*Conn, func()) {
+	server := httptest.NewServer(gateway)
+	conn, err := Dial("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+func send(t *testing.T, conn *Conn, request Request) {
+	data, _ := json.Marshal(request)
+	if err := conn.WriteMessage(TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, conn *Conn) Event {
+	conn.SetReadDeadline(time.Now().Add(frontendtest.Timeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("Bad event %q: %v", data, err)
+	}
+	return event
+}
+
+func TestGateway(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	conn, cleanup := dial(t, New(ps))
+	defer cleanup()
+
+	ps.Push("news", "old")
+	ps.Push("news", "replayed")
+	send(t, conn, Request{Op: "subscribe", Ref: "1", Topic: "news", Since: 1})
+	if event := receive(t, conn); event.Op != "ok" || event.Ref != "1" {
+		t.Fatalf("Expected the subscribe to be answered, got %+v", event)
+	}
+	if event := receive(t, conn); event.Op != "message" || event.Seq != 1 || event.Message.Message != "replayed" {
+		t.Errorf("Expected the message after since to be replayed, got %+v", event)
+	}
+
+	send(t, conn, Request{Op: "subscribe", Ref: "2", Topic: "chat", Filter: `headers.region == "eu"`})
+	receive(t, conn)
+	ps.Push("chat", "filtered out")
+	send(t, conn, Request{Op: "publish", Ref: "3", Topic: "chat", Message: "hallo", Headers: map[string]string{"region": "eu"}})
+	ps.Push("news", "live")
+	// the answer to the publish may come before or after the deliveries
+	received := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		event := receive(t, conn)
+		if event.Op == "ok" {
+			if event.Ref != "3" || event.Id != 2 {
+				t.Errorf("Expected the publish to be answered with its id, got %+v", event)
+			}
+			continue
+		}
+		received[event.Topic+"/"+event.Message.Message] = true
+	}
+	if !received["chat/hallo"] || !received["news/live"] {
+		t.Errorf("Expected the messages of both topics, got %v", received)
+	}
+
+	send(t, conn, Request{Op: "ping", Ref: "4"})
+	if event := receive(t, conn); event.Op != "pong" || event.Ref != "4" {
+		t.Errorf("Expected a pong, got %+v", event)
+	}
+	send(t, conn, Request{Op: "unsubscribe", Ref: "5", Topic: "missing"})
+	if event := receive(t, conn); event.Op != "error" || event.Ref != "5" {
+		t.Errorf("Expected an error for an unknown subscription, got %+v", event)
+	}
+	send(t, conn, Request{Op: "unsubscribe", Ref: "6", Topic: "news"})
+	if event := receive(t, conn); event.Op != "ok" {
+		t.Errorf("Expected the unsubscribe to be answered, got %+v", event)
+	}
+	frontendtest.WaitForSubscribers(t, ps, "news", 0)
+
+	conn.WriteClose(CloseNormal, "")
+	frontendtest.WaitForSubscribers(t, ps, "chat", 0)
+}
+
+func TestGatewayWindow(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	gateway := New(ps)
+	gateway.Window = 1
+	conn, cleanup := dial(t, gateway)
+	defer cleanup()
+
+	send(t, conn, Request{Op: "subscribe", Topic: "test"})
+	receive(t, conn)
+	ps.Push("test", "first")
+	ps.Push("test", "second")
+	event := receive(t, conn)
+	if event.Message.Message != "first" {
+		t.Fatalf("Expected the first message, got %+v", event)
+	}
+	// the second message waits for the ack, so the pong comes first
+	send(t, conn, Request{Op: "ping"})
+	if event := receive(t, conn); event.Op != "pong" {
+		t.Fatalf("Expected the pong before the unacknowledged message, got %+v", event)
+	}
+	send(t, conn, Request{Op: "ack", Seq: event.Seq})
+	if event := receive(t, conn); event.Message == nil || event.Message.Message != "second" {
+		t.Errorf("Expected the second message after the ack, got %+v", event)
+	}
+}
+
+func TestGatewaySlowConsumer(t *testing.T) {
+	t.Parallel()
+	ps := pubysuby.NewPubySuby()
+	gateway := New(ps)
+	gateway.Window = 1
+	gateway.SendQueue = 1
+	conn, cleanup := dial(t, gateway)
+	defer cleanup()
+
+	send(t, conn, Request{Op: "subscribe", Topic: "test"})
+	receive(t, conn)
+	for i := 0; i < 5; i++ {
+		ps.Push("test", "flood")
+	}
+	var closeErr *CloseError
+	for {
+		conn.SetReadDeadline(time.Now().Add(frontendtest.Timeout))
+		_, _, err := conn.ReadMessage()
+		if errors.As(err, &closeErr) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if closeErr.Code != ClosePolicyViolation {
+		t.Errorf("Expected the slow consumer to be closed with 1008, got %+v", closeErr)
+	}
+	frontendtest.WaitForSubscribers(t, ps, "test", 0)
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+	t.Parallel()
+	rec := httptest.NewRecorder()
+	New(pubysuby.NewPubySuby()).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 400 {
+		t.Errorf("Expected 400 for a request without the handshake, got %d", rec.Code)
+	}
+}
+
+func TestUpgradeRejectsCrossOrigin(t *testing.T) {
+	t.Parallel()
+	handshake := func(gateway *Gateway, origin string) int {
+		req := httptest.NewRequest("GET", "http://hub.example/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		gateway.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	gateway := New(pubysuby.NewPubySuby())
+	if code := handshake(gateway, "http://evil.example"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a cross origin handshake, got %d", code)
+	}
+	// the recorder cannot be hijacked, so an accepted origin gets as far as a 500
+	if code := handshake(gateway, "http://hub.example"); code != http.StatusInternalServerError {
+		t.Errorf("Expected a same origin handshake to be accepted, got %d", code)
+	}
+	gateway.CheckOrigin = func(r *http.Request) bool { return r.Header.Get("Origin") == "http://app.example" }
+	if code := handshake(gateway, "http://app.example"); code != http.StatusInternalServerError {
+		t.Errorf("Expected CheckOrigin to accept the origin, got %d", code)
+	}
+}